@@ -0,0 +1,57 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:scope="Namespaced"
+// +kubebuilder:subresource:status
+// NamespacedREST is the namespaced variant of REST. Secrets and config maps
+// referenced by the spec are only resolved in the object's own namespace
+type NamespacedREST struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RESTSpec   `json:"spec"`
+	Status RESTStatus `json:"status,omitempty"`
+}
+
+func (in *NamespacedREST) GetSpec() *RESTSpec {
+	return &in.Spec
+}
+
+func (in *NamespacedREST) GetStatus() *RESTStatus {
+	return &in.Status
+}
+
+// +kubebuilder:object:root=true
+
+// NamespacedRESTList contains a list of NamespacedREST
+type NamespacedRESTList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespacedREST `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespacedREST{}, &NamespacedRESTList{})
+}
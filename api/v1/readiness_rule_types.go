@@ -0,0 +1,83 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Readiness determines when a generated resource is ready. All of the fields that
+// are set must hold for the resource to be ready
+type Readiness struct {
+	// Condition is the type of a status condition that must have status True
+	// +optional
+	Condition string `json:"condition,omitempty"`
+
+	// JSONPath is a path into the object, the object is ready when the value found
+	// equals Value, or is true if Value is not set
+	// +optional
+	JSONPath string `json:"jsonPath,omitempty"`
+
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// Expression is a CEL expression evaluated with the object as self, e.g.
+	// self.status.phase == 'Running', the object is ready when it evaluates to true.
+	// Fields missing from the object leave it not ready, has() tests for them
+	// +optional
+	Expression string `json:"expression,omitempty"`
+
+	// Timeout after which the object fails if still not ready, measured from the
+	// last change of its spec or transition of its status conditions
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// ReadinessRuleSpec defines how objects of a kind are checked for readiness
+type ReadinessRuleSpec struct {
+	// APIVersion and Kind of the objects the rule applies to
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	Readiness `json:",inline"`
+}
+
+// +kubebuilder:object:root=true
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:scope="Cluster"
+// ReadinessRule overrides the readiness check of the objects of a kind generated by
+// templates, for kinds whose readiness is not detected by the default heuristics
+type ReadinessRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ReadinessRuleSpec `json:"spec"`
+}
+
+// +kubebuilder:object:root=true
+
+// ReadinessRuleList contains a list of ReadinessRule
+type ReadinessRuleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ReadinessRule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ReadinessRule{}, &ReadinessRuleList{})
+}
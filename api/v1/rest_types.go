@@ -17,8 +17,31 @@ limitations under the License.
 package v1
 
 import (
+	"encoding/json"
+	"strconv"
+
 	"github.com/flanksource/kommons"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RESTConditionReady is set to True once the last update request succeeded, or
+	// once a successful callback was received if a callback is configured
+	RESTConditionReady = "Ready"
+
+	// RESTOrphanAnnotation set to "true" removes the finalizer of a REST object being
+	// deleted without sending the remove request, e.g. to unblock an object stuck deleting
+	RESTOrphanAnnotation = "templating.flanksource.com/orphan"
+)
+
+type RESTDeletionPolicy string
+
+const (
+	// RESTDeletionPolicyDelete sends the remove request when the REST object is deleted
+	RESTDeletionPolicyDelete RESTDeletionPolicy = "Delete"
+	// RESTDeletionPolicyOrphan leaves the remote resource in place when the REST object is deleted
+	RESTDeletionPolicyOrphan RESTDeletionPolicy = "Orphan"
 )
 
 // RESTSpec defines the desired state of REST
@@ -30,15 +53,86 @@ type RESTSpec struct {
 	// +optional
 	Auth *RESTAuth `json:"auth,omitempty"`
 
-	// Headers are optional http headers to be sent on the request
+	// Headers are optional http headers to be sent on the request, values are templated
 	// +optional
 	Headers map[string]string `json:"headers,omitempty"`
 
+	// HeadersFrom are optional http headers whose value is templated or read from a
+	// secret or config map in the auth namespace. Values read from secrets or config
+	// maps are redacted from logs, events and status
+	// +optional
+	HeadersFrom []kommons.EnvVar `json:"headersFrom,omitempty"`
+
+	// SensitiveHeaders lists headers whose values are redacted from logs, events and status
+	// +optional
+	SensitiveHeaders []string `json:"sensitiveHeaders,omitempty"`
+
 	// Update defines the payload to be sent when CRD item is updated
 	Update RESTAction `json:"update,omitempty"`
 
-	// Remove defines the payload to be sent when CRD item is deleted
+	// Remove defines the payload to be sent when CRD item is deleted, no request is
+	// sent if remove.method is empty. A 404 response is treated as success
 	Remove RESTAction `json:"remove,omitempty"`
+
+	// DeletionPolicy is either Delete, sending the remove request on deletion, or
+	// Orphan, leaving the remote resource in place. Defaults to Delete
+	// +kubebuilder:validation:Enum=Delete;Orphan
+	// +optional
+	DeletionPolicy RESTDeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// RemoveTimeout is how long a failing remove request is retried after deletion before
+	// the finalizer is removed anyway and a warning event is recorded. Defaults to 1h
+	// +optional
+	RemoveTimeout *metav1.Duration `json:"removeTimeout,omitempty"`
+
+	// Callback allows the remote API to report the result of asynchronous requests on
+	// /rest/callback/<name> for REST, or /rest/callback/<namespace>/<name> for NamespacedREST
+	// +optional
+	Callback *RESTCallback `json:"callback,omitempty"`
+
+	// ResyncOnChange re-sends the update request whenever the rendered request differs
+	// from the last one sent, even if the generation did not change, e.g. after a
+	// referenced secret was rotated. Changes to secrets and config maps referenced by
+	// auth, headersFrom and callback trigger a reconcile
+	// +optional
+	ResyncOnChange bool `json:"resyncOnChange,omitempty"`
+
+	// RateLimit overrides the default rate limit of requests sent to the host of the url.
+	// REST objects with the same rate limit for a host share it
+	// +optional
+	RateLimit *RESTRateLimit `json:"rateLimit,omitempty"`
+}
+
+type RESTRateLimit struct {
+	// Requests is the number of requests allowed per period
+	// +kubebuilder:validation:Minimum=1
+	Requests int32 `json:"requests"`
+	// Period defaults to 1s
+	// +optional
+	Period *metav1.Duration `json:"period,omitempty"`
+	// Burst is the number of requests allowed at once, defaults to 1
+	// +optional
+	Burst int32 `json:"burst,omitempty"`
+}
+
+type RESTCallback struct {
+	// Token is compared with the bearer token or the X-Callback-Token header of callbacks
+	// +optional
+	Token *kommons.EnvVarSource `json:"token,omitempty"`
+	// HMAC is the key used to verify the X-Signature-256 header of callbacks, in the
+	// form sha256=<hex digest of "<timestamp>.<body>">, where timestamp is the unix time
+	// sent in the X-Signature-Timestamp header. Callbacks signed more than 5 minutes
+	// away from the current time are rejected
+	// +optional
+	HMAC *kommons.EnvVarSource `json:"hmac,omitempty"`
+	// Status fields are templated from the callback, available as .callback, and
+	// stored in status.outputs
+	// +optional
+	Status map[string]string `json:"status,omitempty"`
+	// Success is templated from the callback and the REST is Ready once it renders
+	// "true". Any verified callback is considered successful if empty
+	// +optional
+	Success string `json:"success,omitempty"`
 }
 
 type RESTAuth struct {
@@ -46,7 +140,9 @@ type RESTAuth struct {
 	Username kommons.EnvVarSource `json:"username,omitempty"`
 	// Password represents the HTTP Basic Auth password
 	Password kommons.EnvVarSource `json:"password,omitempty"`
-	// Namespace where secret / config map is present
+	// Namespace where secret / config map is present, also used for headersFrom.
+	// NamespacedREST objects always use their own namespace and may only leave
+	// this empty or set it to it
 	Namespace string `json:"namespace,omitempty"`
 }
 
@@ -59,9 +155,186 @@ type RESTAction struct {
 	// Body represents the HTTP Request body
 	// +optional
 	Body string `json:"body,omitempty"`
-	// Status defines the status fields which will be updated based on response status
+	// GraphQL sends a GraphQL query instead of body, using POST unless method is set.
+	// Errors in the response are treated as failures and .response is the data of
+	// the response
+	// +optional
+	GraphQL *RESTGraphQL `json:"graphql,omitempty"`
+	// Status defines the fields templated from the response and stored in status.outputs.
+	// The response is available as .response, which contains the fields of the decoded body
+	// along with body, raw, headers and statusCode
 	// +optional
 	Status map[string]string `json:"status,omitempty"`
+	// JSONPath defines fields extracted from the response using a gjson path (e.g. body.items.0.id)
+	// and stored in status.outputs. Takes precedence over a status field with the same name
+	// +optional
+	JSONPath map[string]string `json:"jsonPath,omitempty"`
+	// Sensitive lists status and jsonPath fields whose values are not persisted or logged,
+	// they are stored as [REDACTED] instead
+	// +optional
+	Sensitive []string `json:"sensitive,omitempty"`
+	// Poll a status endpoint after the request until an asynchronous operation completes.
+	// Only used for the update action of REST and NamespacedREST
+	// +optional
+	Poll *RESTPoll `json:"poll,omitempty"`
+}
+
+type RESTGraphQL struct {
+	// Query is the GraphQL query or mutation
+	Query string `json:"query"`
+	// Variables is a JSON object templated with the REST object
+	// +optional
+	Variables string `json:"variables,omitempty"`
+}
+
+type RESTPoll struct {
+	// URL of the status endpoint, templated with the REST object, e.g. using
+	// .status.outputs.operationID from the update response
+	URL string `json:"url"`
+	// Interval between polls, defaults to 10s
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Timeout after which polling fails, defaults to 10m
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Success is templated with the poll response as .response, polling completes
+	// once it renders "true"
+	Success string `json:"success"`
+	// Failure is templated with the poll response as .response, polling fails
+	// once it renders "true"
+	// +optional
+	Failure string `json:"failure,omitempty"`
+	// Status defines the fields templated from the poll response and stored in status.outputs
+	// +optional
+	Status map[string]string `json:"status,omitempty"`
+	// JSONPath defines fields extracted from the poll response and stored in status.outputs
+	// +optional
+	JSONPath map[string]string `json:"jsonPath,omitempty"`
+}
+
+// RESTStatus defines the observed state of REST
+type RESTStatus struct {
+	// ObservedGeneration is the last generation successfully sent to the remote API
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions represent the latest available observations of the REST state
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// LastRequest describes the last request sent to the remote API
+	// +optional
+	LastRequest *RESTRequestStatus `json:"lastRequest,omitempty"`
+	// History describes the last requests sent to the remote API, oldest first
+	// +optional
+	History []RESTRequestStatus `json:"history,omitempty"`
+	// RequestHash is a digest of the update request rendered with the current status,
+	// used by resyncOnChange to detect changes
+	// +optional
+	RequestHash string `json:"requestHash,omitempty"`
+	// Outputs contains the fields templated from the response using update.status
+	// +optional
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// Poll describes the progress of update.poll for the observed generation
+	// +optional
+	Poll *RESTPollStatus `json:"poll,omitempty"`
+
+	// legacy is set if the status was decoded from the flat map of strings written by
+	// previous versions of the operator, it is migrated on the next reconcile
+	legacy bool
+}
+
+// IsLegacy returns whether the status was written by a previous version of the
+// operator and still has to be migrated
+func (in *RESTStatus) IsLegacy() bool {
+	return in.legacy
+}
+
+const (
+	RESTPollPolling   = "Polling"
+	RESTPollSucceeded = "Succeeded"
+	RESTPollFailed    = "Failed"
+)
+
+type RESTPollStatus struct {
+	// Phase is one of Polling, Succeeded or Failed
+	Phase string `json:"phase"`
+	// StartTime is when the update request completed and polling started
+	StartTime metav1.Time `json:"startTime"`
+	// Attempts is the number of poll requests sent
+	// +optional
+	Attempts int `json:"attempts,omitempty"`
+	// LastPollTime is when the last poll request was sent
+	// +optional
+	LastPollTime *metav1.Time `json:"lastPollTime,omitempty"`
+	// Message describes the last poll attempt
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+type RESTRequestStatus struct {
+	// Action is the action the request was sent for, one of update, remove or poll
+	// +optional
+	Action string `json:"action,omitempty"`
+	// Method is the HTTP method used for the request
+	Method string `json:"method,omitempty"`
+	// URL is the URL the request was sent to
+	URL string `json:"url,omitempty"`
+	// StatusCode is the HTTP status code returned, 0 if no response was received
+	// +optional
+	StatusCode int `json:"statusCode,omitempty"`
+	// Duration is the time taken to receive a response
+	// +optional
+	Duration metav1.Duration `json:"duration,omitempty"`
+	// Time is when the request was sent
+	// +optional
+	Time metav1.Time `json:"time,omitempty"`
+}
+
+// UnmarshalJSON decodes the status written by previous versions of the operator,
+// a flat map of strings with observedGeneration stored as a string, into the
+// structured status. The string fields of a legacy status become outputs, so that
+// templates referencing .status.<field> keep working. Unknown fields of a structured
+// status are ignored.
+func (in *RESTStatus) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var generation string
+	if value, found := fields["observedGeneration"]; !found || json.Unmarshal(value, &generation) != nil {
+		type restStatus RESTStatus
+		status := restStatus{}
+		if err := json.Unmarshal(data, &status); err != nil {
+			return err
+		}
+		*in = RESTStatus(status)
+		return nil
+	}
+
+	status := RESTStatus{legacy: true, Outputs: map[string]string{}}
+	status.ObservedGeneration, _ = strconv.ParseInt(generation, 10, 64)
+	for key, value := range fields {
+		switch key {
+		case "observedGeneration":
+		case "lastUpdated":
+			// superseded by lastRequest.time
+		default:
+			var v string
+			if err := json.Unmarshal(value, &v); err == nil {
+				status.Outputs[key] = v
+			}
+		}
+	}
+	*in = status
+	return nil
+}
+
+// RESTObject is implemented by REST and NamespacedREST
+// +kubebuilder:object:generate=false
+type RESTObject interface {
+	client.Object
+	GetSpec() *RESTSpec
+	GetStatus() *RESTStatus
 }
 
 // +kubebuilder:object:root=true
@@ -75,8 +348,18 @@ type REST struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
 	Spec RESTSpec `json:"spec"`
+	// Status keeps unknown fields so that the flat status written by previous
+	// versions is not pruned before it is migrated
 	// +kubebuilder:pruning:PreserveUnknownFields
-	Status map[string]string `json:"status,omitempty"`
+	Status RESTStatus `json:"status,omitempty"`
+}
+
+func (in *REST) GetSpec() *RESTSpec {
+	return &in.Spec
+}
+
+func (in *REST) GetStatus() *RESTStatus {
+	return &in.Status
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,81 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// TemplateRevisionLabel is set on generated objects to the revision of the template
+// that produced them, and on revisions to the name of their template
+const (
+	TemplateRevisionLabel = "templating.flanksource.com/revision"
+	TemplateNameLabel     = "templating.flanksource.com/template"
+)
+
+// TemplateRevisionSpec is a snapshot of the fields of a TemplateSpec that determine
+// the objects generated for each source
+type TemplateRevisionSpec struct {
+	// Template is the name of the template the revision belongs to
+	Template string `json:"template"`
+	// Revision is the hash of the snapshot
+	Revision string `json:"revision"`
+
+	// +optional
+	Resources []runtime.RawExtension `json:"resources,omitempty"`
+	// +optional
+	ResourcesTemplate string `json:"resourcesTemplate,omitempty"`
+	// +optional
+	Patches []string `json:"patches,omitempty"`
+	// +optional
+	JsonPatches []JsonPatch `json:"jsonPatches,omitempty"`
+	// +optional
+	CopyToNamespaces *CopyToNamespaces `json:"copyToNamespaces,omitempty"`
+	// +optional
+	HTTP *TemplateHTTP `json:"http,omitempty"`
+	// +optional
+	Dependencies *TemplateDependencies `json:"dependencies,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:scope="Cluster"
+// TemplateRevision is an immutable snapshot of a Template, created for each change
+// of the template so that it can be pinned to a previous revision
+type TemplateRevision struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Spec is immutable, which is enforced by the API server from Kubernetes 1.25
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="revisions are immutable"
+	Spec TemplateRevisionSpec `json:"spec"`
+}
+
+// +kubebuilder:object:root=true
+
+// TemplateRevisionList contains a list of TemplateRevision
+type TemplateRevisionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TemplateRevision `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplateRevision{}, &TemplateRevisionList{})
+}
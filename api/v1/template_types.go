@@ -17,8 +17,10 @@ limitations under the License.
 package v1
 
 import (
+	"github.com/flanksource/kommons"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // TemplateSpec defines the desired state of Template
@@ -33,6 +35,9 @@ type TemplateSpec struct {
 
 	// Resources is a list of new resources to create for each source object found
 	// Must specify at least resources or patches or both
+	// Resources with a depends field are rendered once the resources they depend on
+	// are ready, with their live objects available as .resources.<id>. A readiness
+	// field overrides how a resource is checked for readiness
 	// +optional
 	Resources []runtime.RawExtension `json:"resources,omitempty"`
 
@@ -52,10 +57,253 @@ type TemplateSpec struct {
 
 	// Onceoff will not apply templating more than once (usually at admission stage)
 	Onceoff bool `json:"onceoff,omitempty"`
+
+	// HTTP sends a request for each source object, and writes the response back
+	// onto the source
+	// +optional
+	HTTP *TemplateHTTP `json:"http,omitempty"`
+
+	// Dependencies configures how generated resources wait for the resources listed
+	// in their depends field, individual depends entries may override it
+	// +optional
+	Dependencies *TemplateDependencies `json:"dependencies,omitempty"`
+
+	// SourceStatus controls how the readiness of the generated resources is written
+	// onto each source object: not at all, as an annotation, or as a status condition.
+	// Defaults to None, as sources are usually owned by other controllers
+	// +kubebuilder:validation:Enum=None;Annotation;Condition
+	// +kubebuilder:default=None
+	// +optional
+	SourceStatus SourceStatusMode `json:"sourceStatus,omitempty"`
+
+	// Suspend stops the template from reconciling its sources until it is set back to false
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Rollout applies changes of the template to its sources in batches, by default
+	// all sources are updated at once
+	// +optional
+	Rollout *TemplateRollout `json:"rollout,omitempty"`
+
+	// Revision pins the template to a previous TemplateRevision, by hash, whose
+	// resources and patches are applied instead of the ones in this spec
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// Priority of the template when it generates the same objects, or patches the same
+	// source fields, as other templates. Objects are owned by the first template to
+	// create them, unless a template with a higher priority takes them over
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// TemplateRollout is the strategy used to roll out a new generation of a template.
+// The next batch is only started once all sources of the previous batches are ready,
+// and the rollout halts if any of them is still failed or not ready after ProgressDeadline
+type TemplateRollout struct {
+	// CanarySelector selects the sources updated in the first batch
+	// +optional
+	CanarySelector *metav1.LabelSelector `json:"canarySelector,omitempty"`
+
+	// BatchSize is the number or percentage of sources updated per batch, defaults
+	// to all sources
+	// +optional
+	BatchSize *intstr.IntOrString `json:"batchSize,omitempty"`
+
+	// Pause between batches
+	// +optional
+	Pause *metav1.Duration `json:"pause,omitempty"`
+
+	// ProgressDeadline is the time the sources of a batch have to become ready once
+	// it started before the rollout halts, defaults to 10m
+	// +optional
+	ProgressDeadline *metav1.Duration `json:"progressDeadline,omitempty"`
+}
+
+type RolloutPhase string
+
+const (
+	RolloutProgressing RolloutPhase = "Progressing"
+	RolloutHalted      RolloutPhase = "Halted"
+	RolloutCompleted   RolloutPhase = "Completed"
+)
+
+// TemplateRolloutStatus is the progress of the rollout of a template generation. The
+// sources of each batch are derived from the batch count and the current sources
+type TemplateRolloutStatus struct {
+	// Generation of the template being rolled out
+	Generation int64        `json:"generation"`
+	Phase      RolloutPhase `json:"phase"`
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Batches is the number of batches started
+	Batches int `json:"batches,omitempty"`
+	// LastBatchTime is the time the last batch was started
+	// +optional
+	LastBatchTime *metav1.Time `json:"lastBatchTime,omitempty"`
+	// Updated is the number of sources of the batches started so far
+	// +optional
+	Updated int `json:"updated,omitempty"`
+	// Ready is the number of updated sources whose generated resources are ready
+	// +optional
+	Ready int `json:"ready,omitempty"`
+}
+
+// TemplateConditionSuspended is True while spec.suspend is set
+const TemplateConditionSuspended = "Suspended"
+
+// TemplateConditionConflict is True while objects or source fields generated by the
+// template are owned by other templates
+const TemplateConditionConflict = "Conflict"
+
+type SourceStatusMode string
+
+const (
+	SourceStatusNone       SourceStatusMode = "None"
+	SourceStatusAnnotation SourceStatusMode = "Annotation"
+	SourceStatusCondition  SourceStatusMode = "Condition"
+)
+
+// TemplateDependencies configures the wait of generated resources on their dependencies
+type TemplateDependencies struct {
+	// Interval between readiness checks of dependencies that are not ready, defaults to 2m
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// Timeout after which a resource still waiting on a dependency fails, by default
+	// resources wait indefinitely
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
 }
 
-// TemplateStatus defines the observed state of Template
+type TemplateHTTP struct {
+	// URL, method and body of the request, templated with the source object.
+	// Status and jsonPath fields are patched into the source status, they must be
+	// fields of the status schema of the source. Requests are sent with an
+	// Idempotency-Key header unique to the source and rendered request
+	RESTAction `json:",inline"`
+
+	// Auth may be used for http basic authentication
+	// +optional
+	Auth *RESTAuth `json:"auth,omitempty"`
+
+	// Headers are optional http headers to be sent on the request, values are templated
+	// +optional
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// HeadersFrom are optional http headers whose value is templated or read from a
+	// secret or config map in the auth namespace
+	// +optional
+	HeadersFrom []kommons.EnvVar `json:"headersFrom,omitempty"`
+
+	// SensitiveHeaders lists headers whose values are redacted from logs and events
+	// +optional
+	SensitiveHeaders []string `json:"sensitiveHeaders,omitempty"`
+
+	// Annotations are templated from the response, available as .response, and
+	// set on the source object
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Update is sent instead of the request when the rendered request changes after
+	// it was sent for a source, e.g. a PUT to the resource created by the request.
+	// The request is not re-sent on changes if empty
+	// +optional
+	Update *RESTAction `json:"update,omitempty"`
+}
+
+// TemplateStatus defines the observed state of Template. As a template may have
+// thousands of sources, sources are counted and lists are limited to MaxStatusEntries
+// entries: the state of each source is recorded on the source, depending on
+// spec.sourceStatus, and as events
 type TemplateStatus struct {
+	// Conditions represent the latest available observations of the Template state
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Rollout is the progress of the rollout of the template, if spec.rollout is set
+	// +optional
+	Rollout *TemplateRolloutStatus `json:"rollout,omitempty"`
+
+	// Revision is the hash of the TemplateRevision of the current spec
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// Summary counts the sources of the template by the state of their generated resources
+	// +optional
+	Summary *TemplateSummary `json:"summary,omitempty"`
+
+	// Blocked lists the generated resources waiting for the resources they depend on,
+	// ordered by source
+	// +optional
+	Blocked []BlockedResource `json:"blocked,omitempty"`
+
+	// Sources lists the sources the template revision is not applied to yet, with the
+	// revision they are on, ordered by source. The other sources are on the pinned
+	// revision if spec.revision is set, or on Revision otherwise
+	// +optional
+	Sources []SourceRevision `json:"sources,omitempty"`
+}
+
+// SourceRevision is the revision of a template last applied to a source
+type SourceRevision struct {
+	// Source is the kind/namespace/name of the source
+	Source string `json:"source"`
+	// Revision is the hash of the TemplateRevision last applied to the source, empty
+	// if none was applied since the operator started
+	// +optional
+	Revision string `json:"revision,omitempty"`
+}
+
+// MaxStatusEntries is the maximum number of entries of the lists of a template status
+const MaxStatusEntries = 50
+
+// BlockedResource is a generated resource that is not applied as some of its
+// dependencies are not ready
+type BlockedResource struct {
+	// Source is the kind/namespace/name of the source the resource is generated for
+	Source string `json:"source"`
+	// ID of the resource, resources depending on others are only named once rendered
+	// +optional
+	ID string `json:"id,omitempty"`
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// +optional
+	Name string `json:"name,omitempty"`
+	// WaitingFor lists the ids of the dependencies that are not ready
+	WaitingFor []string `json:"waitingFor,omitempty"`
+	// Since is the time the resource started waiting
+	Since metav1.Time `json:"since,omitempty"`
+	// TimedOut is set once a dependency was not ready within its timeout
+	// +optional
+	TimedOut bool `json:"timedOut,omitempty"`
+}
+
+// TemplateSummary counts the sources reconciled since the operator started, by the
+// state of the resources generated for them
+type TemplateSummary struct {
+	// Sources is the number of sources
+	Sources int `json:"sources"`
+	// Updated is the number of sources the revision of the current spec, or the pinned
+	// revision, was last applied to
+	// +optional
+	Updated int `json:"updated,omitempty"`
+	// +optional
+	Ready int `json:"ready,omitempty"`
+	// +optional
+	NotReady int `json:"notReady,omitempty"`
+	// Blocked is the number of sources with resources waiting for their dependencies
+	// +optional
+	Blocked int `json:"blocked,omitempty"`
+	// Conflicts is the number of sources with objects or fields owned by other
+	// templates, they are also counted by their readiness
+	// +optional
+	Conflicts int `json:"conflicts,omitempty"`
+	// Failed is the number of sources whose resources failed to be applied
+	// +optional
+	Failed int `json:"failed,omitempty"`
 }
 
 type ResourceSelector struct {
@@ -93,6 +341,7 @@ type GitRepository struct {
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:resource:scope="Cluster"
+// +kubebuilder:subresource:status
 // Template is the Schema for the templates API
 type Template struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -6,6 +6,7 @@ import (
 	"github.com/flanksource/kommons"
 	"github.com/flanksource/template-operator/k8s"
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/tools/record"
@@ -17,6 +18,8 @@ const (
 	CRDV1Group   = "apiextensions.k8s.io"
 )
 
+var tracer = otel.Tracer("github.com/flanksource/template-operator/controllers")
+
 type Client struct {
 	ControllerClient client.Client
 	KommonsClient    *kommons.Client
@@ -0,0 +1,160 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	restCallbackPath = "/rest/callback/"
+	// maxCallbackBodySize limits the size of callback bodies read into memory
+	maxCallbackBodySize = 1 << 20
+)
+
+// RESTCallbackServer receives callbacks from remote APIs and maps them into the
+// status of REST objects on /rest/callback/<name>, and of NamespacedREST objects
+// on /rest/callback/<namespace>/<name>
+type RESTCallbackServer struct {
+	Client
+	Addr string
+}
+
+func (s *RESTCallbackServer) SetupWithManager(mgr ctrl.Manager) error {
+	s.ControllerClient = mgr.GetClient()
+	s.Events = mgr.GetEventRecorderFor("template-operator")
+
+	return mgr.Add(s)
+}
+
+// NeedLeaderElection returns false so that callbacks are served by every replica
+func (s *RESTCallbackServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *RESTCallbackServer) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(restCallbackPath, s.handleCallback)
+	server := &http.Server{Addr: s.Addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			s.Log.Error(err, "failed to shutdown callback server")
+		}
+	}()
+
+	s.Log.Info("starting callback server", "addr", s.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "failed to start callback server")
+	}
+	return nil
+}
+
+func (s *RESTCallbackServer) handleCallback(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rest templatev1.RESTObject
+	key := types.NamespacedName{}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, restCallbackPath), "/")
+	switch len(parts) {
+	case 1:
+		rest = &templatev1.REST{}
+		key.Name = parts[0]
+	case 2:
+		rest = &templatev1.NamespacedREST{}
+		key.Namespace, key.Name = parts[0], parts[1]
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	log := s.Log.WithValues("rest", key)
+
+	ctx := req.Context()
+	if err := s.ControllerClient.Get(ctx, key, rest); err != nil {
+		if kerrors.IsNotFound(err) {
+			http.NotFound(w, req)
+			return
+		}
+		log.Error(err, "failed to get rest")
+		http.Error(w, "failed to get rest", http.StatusInternalServerError)
+		return
+	}
+	if rest.GetSpec().Callback == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxCallbackBodySize))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	tm, err := k8s.NewRESTManager(s.KommonsClient, log)
+	if err != nil {
+		http.Error(w, "failed to create rest manager", http.StatusInternalServerError)
+		return
+	}
+	tm.Namespace = rest.GetNamespace()
+	if err := tm.VerifyCallback(rest, req.Header, body); err != nil {
+		log.Error(err, "callback rejected")
+		if errors.Is(err, k8s.ErrCallbackUnauthorized) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "failed to verify callback", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	oldStatus := rest.GetStatus().DeepCopy()
+	success, callbackErr := tm.Callback(rest, req.Header, body)
+	if callbackErr != nil {
+		log.Error(callbackErr, "failed to process callback")
+		setRESTCondition(rest, metav1.ConditionFalse, "CallbackFailed", callbackErr.Error())
+	} else if success {
+		setRESTCondition(rest, metav1.ConditionTrue, "CallbackSucceeded", "")
+	} else {
+		setRESTCondition(rest, metav1.ConditionFalse, "CallbackReceived", "callback success condition not met")
+	}
+
+	reconciler := &RESTReconciler{Client: s.Client}
+	if err := reconciler.updateStatus(ctx, rest, oldStatus); err != nil {
+		log.Error(err, "failed to update rest status")
+		http.Error(w, "failed to update status", http.StatusInternalServerError)
+		return
+	}
+	if callbackErr != nil {
+		http.Error(w, callbackErr.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -27,13 +27,17 @@ import (
 	templatev1 "github.com/flanksource/template-operator/api/v1"
 	"github.com/flanksource/template-operator/k8s"
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -45,48 +49,31 @@ var (
 	RESTDeleteFinalizer = "termination.flanksource.com/protect"
 )
 
-var (
-	restCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "template_operator_rest_count",
-			Help: "Total rest runs count",
-		},
-		[]string{"rest"},
-	)
-	restSuccess = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "template_operator_rest_success",
-			Help: "Total successful rest runs count",
-		},
-		[]string{"rest"},
-	)
-	restFailed = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "template_operator_rest_failed",
-			Help: "Total failed rest runs count",
-		},
-		[]string{"test"},
-	)
-)
-
-func init() {
-	metrics.Registry.MustRegister(restCount, restSuccess, restFailed)
-}
-
 // RESTReconciler reconciles a REST object
 type RESTReconciler struct {
 	Client
+	// RateLimiter is shared by all reconciles to limit the rate of requests per host
+	RateLimiter             *k8s.HostRateLimiter
+	MaxConcurrentReconciles int
+	// HistoryLimit is the number of requests kept in the status of each REST object
+	HistoryLimit int
 }
 
 // +kubebuilder:rbac:groups="*",resources="*",verbs="*"
 
 func (r *RESTReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return r.reconcile(ctx, req, &templatev1.REST{})
+}
+
+// reconcile is shared by REST and NamespacedREST, rest is the empty object to fetch into
+func (r *RESTReconciler) reconcile(ctx context.Context, req ctrl.Request, rest templatev1.RESTObject) (ctrl.Result, error) {
 	log := r.Log.WithValues("rest", req.NamespacedName, "requestID", utils.RandomString(10))
 	name := req.NamespacedName.String()
+	ctx, span := tracer.Start(ctx, "RESTReconciler.Reconcile", trace.WithAttributes(attribute.String("rest", name)))
+	defer span.End()
 
 	log.V(2).Info("Started reconciling")
 
-	rest := &templatev1.REST{}
 	if err := r.ControllerClient.Get(ctx, req.NamespacedName, rest); err != nil {
 		if kerrors.IsNotFound(err) {
 			log.Error(err, "rest not found")
@@ -97,10 +84,7 @@ func (r *RESTReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		return reconcile.Result{}, err
 	}
 
-	if rest.Status == nil {
-		rest.Status = map[string]string{}
-	}
-	oldStatus := cloneMap(rest.Status)
+	oldStatus := rest.GetStatus().DeepCopy()
 
 	//If the TemplateManager will fetch a new schema, ensure the kommons.client also does so in order to ensure they contain the same information
 	if r.Cache.SchemaHasExpired() {
@@ -111,28 +95,29 @@ func (r *RESTReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		incRESTFailed(name)
 		return reconcile.Result{}, err
 	}
+	tm.RateLimiter = r.RateLimiter
+	tm.Events = r.Events
+	tm.HistoryLimit = r.HistoryLimit
+	tm.Namespace = rest.GetNamespace()
 
 	hasFinalizer := false
-	for _, finalizer := range rest.ObjectMeta.Finalizers {
+	for _, finalizer := range rest.GetFinalizers() {
 		if finalizer == RESTDeleteFinalizer {
 			hasFinalizer = true
 		}
 	}
 
-	if rest.ObjectMeta.DeletionTimestamp != nil {
+	if rest.GetDeletionTimestamp() != nil {
 		log.V(2).Info("Object marked as deleted")
-		if err = tm.Delete(ctx, rest); err != nil {
-			return reconcile.Result{}, err
+		if !hasFinalizer {
+			return ctrl.Result{}, nil
 		}
-		if err := r.removeFinalizers(rest); err != nil {
-			return ctrl.Result{}, err
-		}
-		return ctrl.Result{}, nil
+		return r.delete(ctx, tm, rest, oldStatus)
 	}
 
 	if !hasFinalizer {
 		log.V(2).Info("Setting finalizer")
-		rest.ObjectMeta.Finalizers = append(rest.ObjectMeta.Finalizers, RESTDeleteFinalizer)
+		rest.SetFinalizers(append(rest.GetFinalizers(), RESTDeleteFinalizer))
 		if err := r.ControllerClient.Update(ctx, rest); err != nil {
 			log.Error(err, "failed to add finalizer to object")
 			return ctrl.Result{}, err
@@ -142,23 +127,83 @@ func (r *RESTReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		return ctrl.Result{}, nil
 	}
 
-	statusUpdates, err := tm.Update(ctx, rest)
-	if err != nil {
+	if err := tm.Update(ctx, rest); err != nil {
 		log.Error(err, "Failed to run update REST")
 		incRESTFailed(name)
+		setRESTCondition(rest, metav1.ConditionFalse, "RequestFailed", err.Error())
+		if err := r.updateStatus(ctx, rest, oldStatus); err != nil {
+			log.Error(err, "Failed to update REST status")
+		}
+		return reconcile.Result{}, err
+	}
+
+	requeueAfter, err := tm.Poll(ctx, rest)
+	if err != nil {
+		log.Error(err, "Failed to poll REST")
+		incRESTFailed(name)
+		setRESTCondition(rest, metav1.ConditionFalse, "PollFailed", err.Error())
+		if err := r.updateStatus(ctx, rest, oldStatus); err != nil {
+			log.Error(err, "Failed to update REST status")
+		}
 		return reconcile.Result{}, err
 	}
+	if poll := rest.GetStatus().Poll; poll != nil && poll.Phase != templatev1.RESTPollSucceeded {
+		if poll.Phase == templatev1.RESTPollPolling {
+			setRESTCondition(rest, metav1.ConditionFalse, "Polling", poll.Message)
+		} else {
+			incRESTFailed(name)
+			setRESTCondition(rest, metav1.ConditionFalse, "PollFailed", poll.Message)
+		}
+		if err := r.updateStatus(ctx, rest, oldStatus); err != nil {
+			return reconcile.Result{}, err
+		}
+		return reconcile.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	if rest.GetSpec().Callback == nil {
+		setRESTCondition(rest, metav1.ConditionTrue, "RequestSucceeded", "")
+	} else if k8s.WaitingForCallback(rest.GetStatus().Conditions, rest.GetGeneration()) {
+		setRESTCondition(rest, metav1.ConditionFalse, k8s.RESTReasonWaitingForCallback, "request sent, waiting for callback")
+	}
 
-	if err := r.updateStatus(ctx, rest, statusUpdates, oldStatus); err != nil {
+	if err := r.updateStatus(ctx, rest, oldStatus); err != nil {
 		return reconcile.Result{}, err
 	}
 
 	incRESTSuccess(name)
-	log.V(2).Info("Finished reconciling", "generation", rest.ObjectMeta.Generation)
+	log.V(2).Info("Finished reconciling", "generation", rest.GetGeneration())
 	return ctrl.Result{}, nil
 }
 
-func (r *RESTReconciler) updateStatus(ctx context.Context, rest *templatev1.REST, statusUpdates, oldStatus map[string]string) error {
+// delete sends the remove request unless the REST object is orphaned, and removes the
+// finalizer once it succeeded or once spec.removeTimeout has passed since deletion
+func (r *RESTReconciler) delete(ctx context.Context, tm *k8s.RESTManager, rest templatev1.RESTObject, oldStatus *templatev1.RESTStatus) (ctrl.Result, error) {
+	log := tm.Log
+	if k8s.IsOrphaned(rest) {
+		log.Info("Orphaning remote resource, skipping remove request")
+		r.Events.Event(rest, v1.EventTypeNormal, "Orphaned", "Remove request skipped, the remote resource was left in place")
+		return ctrl.Result{}, r.removeFinalizers(rest)
+	}
+
+	err := tm.Delete(ctx, rest)
+	if err == nil {
+		return ctrl.Result{}, r.removeFinalizers(rest)
+	}
+
+	log.Error(err, "Failed to run remove REST")
+	if timeout, timedOut := k8s.RemoveTimedOut(rest, time.Now()); timedOut {
+		r.Events.Eventf(rest, v1.EventTypeWarning, "RemoveFailed", "Remove request failed for %v, removing finalizer: %v", timeout, err)
+		return ctrl.Result{}, r.removeFinalizers(rest)
+	}
+
+	setRESTCondition(rest, metav1.ConditionFalse, "RemoveFailed", err.Error())
+	if err := r.updateStatus(ctx, rest, oldStatus); err != nil {
+		log.Error(err, "Failed to update REST status")
+	}
+	return ctrl.Result{}, err
+}
+
+func (r *RESTReconciler) updateStatus(ctx context.Context, rest templatev1.RESTObject, oldStatus *templatev1.RESTStatus) error {
 	backoff := wait.Backoff{
 		Duration: 50 * time.Millisecond,
 		Factor:   1.5,
@@ -168,22 +213,20 @@ func (r *RESTReconciler) updateStatus(ctx context.Context, rest *templatev1.REST
 	}
 	var err error
 
-	r.addStatusUpdates(rest, statusUpdates)
-
-	if reflect.DeepEqual(rest.Status, oldStatus) {
+	// a status written by a previous version is always rewritten to migrate it
+	if !oldStatus.IsLegacy() && reflect.DeepEqual(rest.GetStatus(), oldStatus) {
 		r.Log.V(2).Info("REST status did not change, skipping")
 		return nil
 	}
 
-	setRestStatus(rest)
+	status := rest.GetStatus().DeepCopy()
 
-	js, _ := json.Marshal(rest.Status)
+	js, _ := json.Marshal(status)
 	js2, _ := json.Marshal(oldStatus)
 	r.Log.V(2).Info("Checking:", "status", string(js), "oldStatus", string(js2))
 
 	for backoff.Steps > 0 {
-		js, err := json.Marshal(statusUpdates)
-		r.Log.V(2).Info("Updating status: setting", "statusUpdates", string(js), "err", err)
+		r.Log.V(2).Info("Updating status: setting", "status", string(js))
 		if err = r.ControllerClient.Status().Update(ctx, rest); err == nil {
 			return nil
 		}
@@ -191,21 +234,17 @@ func (r *RESTReconciler) updateStatus(ctx context.Context, rest *templatev1.REST
 		r.Log.Info("update status failed, sleeping", "duration", sleepDuration, "err", err)
 		time.Sleep(sleepDuration)
 		if strings.Contains(err.Error(), objectModifiedError) {
-			if err := r.ControllerClient.Get(context.Background(), types.NamespacedName{Name: rest.Name}, rest); err != nil {
+			if err := r.ControllerClient.Get(context.Background(), client.ObjectKeyFromObject(rest), rest); err != nil {
 				return errors.Wrap(err, "failed to refetch object")
 			}
-			r.addStatusUpdates(rest, statusUpdates)
-			if reflect.DeepEqual(rest.Status, oldStatus) {
-				return nil
-			}
-			setRestStatus(rest)
+			k8s.MergeRESTStatus(rest.GetStatus(), oldStatus, status)
 		}
 	}
 
 	return err
 }
 
-func (r *RESTReconciler) removeFinalizers(rest *templatev1.REST) error {
+func (r *RESTReconciler) removeFinalizers(rest templatev1.RESTObject) error {
 	backoff := wait.Backoff{
 		Duration: 50 * time.Millisecond,
 		Factor:   1.5,
@@ -215,7 +254,7 @@ func (r *RESTReconciler) removeFinalizers(rest *templatev1.REST) error {
 	}
 	var err error
 
-	rest.ObjectMeta.Finalizers = r.removeFinalizer(rest)
+	rest.SetFinalizers(r.removeFinalizer(rest))
 
 	for backoff.Steps > 0 {
 		if err = r.ControllerClient.Update(context.Background(), rest); err == nil {
@@ -225,19 +264,19 @@ func (r *RESTReconciler) removeFinalizers(rest *templatev1.REST) error {
 		r.Log.Info("remove finalizers failed, sleeping", "duration", sleepDuration, "err", err)
 		time.Sleep(sleepDuration)
 		if strings.Contains(err.Error(), objectModifiedError) {
-			if err := r.ControllerClient.Get(context.Background(), types.NamespacedName{Name: rest.Name}, rest); err != nil {
+			if err := r.ControllerClient.Get(context.Background(), client.ObjectKeyFromObject(rest), rest); err != nil {
 				return errors.Wrap(err, "failed to refetch object")
 			}
-			rest.ObjectMeta.Finalizers = r.removeFinalizer(rest)
+			rest.SetFinalizers(r.removeFinalizer(rest))
 		}
 	}
 
 	return nil
 }
 
-func (r *RESTReconciler) removeFinalizer(rest *templatev1.REST) []string {
+func (r *RESTReconciler) removeFinalizer(rest templatev1.RESTObject) []string {
 	finalizers := []string{}
-	for _, finalizer := range rest.ObjectMeta.Finalizers {
+	for _, finalizer := range rest.GetFinalizers() {
 		if finalizer != RESTDeleteFinalizer {
 			finalizers = append(finalizers, finalizer)
 		}
@@ -245,42 +284,97 @@ func (r *RESTReconciler) removeFinalizer(rest *templatev1.REST) []string {
 	return finalizers
 }
 
-func (r *RESTReconciler) addStatusUpdates(rest *templatev1.REST, statusUpdates map[string]string) {
-	if rest.Status == nil {
-		rest.Status = map[string]string{}
+func (r *RESTReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.ControllerClient = mgr.GetClient()
+	r.Events = mgr.GetEventRecorderFor("template-operator")
+
+	list := func(ctx context.Context, namespace string) ([]templatev1.RESTObject, error) {
+		rests := &templatev1.RESTList{}
+		if err := r.ControllerClient.List(ctx, rests); err != nil {
+			return nil, err
+		}
+		objects := []templatev1.RESTObject{}
+		for i := range rests.Items {
+			objects = append(objects, &rests.Items[i])
+		}
+		return objects, nil
 	}
-	for k, v := range statusUpdates {
-		rest.Status[k] = v
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&templatev1.REST{}).
+		WatchesMetadata(&v1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.referencedBy(list, true))).
+		WatchesMetadata(&v1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.referencedBy(list, false))).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Complete(r)
+}
+
+// referencedBy returns a map function enqueueing the objects returned by list which
+// have resyncOnChange set and reference the changed secret, or config map if secret is false
+func (r *RESTReconciler) referencedBy(list func(ctx context.Context, namespace string) ([]templatev1.RESTObject, error), secret bool) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		rests, err := list(ctx, obj.GetNamespace())
+		if err != nil {
+			r.Log.Error(err, "failed to list rest objects", "namespace", obj.GetNamespace())
+			return nil
+		}
+
+		requests := []reconcile.Request{}
+		for _, rest := range rests {
+			if k8s.ResyncOnChange(rest, obj.GetNamespace(), obj.GetName(), secret) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(rest)})
+			}
+		}
+		return requests
 	}
 }
 
-func (r *RESTReconciler) SetupWithManager(mgr ctrl.Manager) error {
+// NamespacedRESTReconciler reconciles a NamespacedREST object
+type NamespacedRESTReconciler struct {
+	RESTReconciler
+}
+
+func (r *NamespacedRESTReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	return r.reconcile(ctx, req, &templatev1.NamespacedREST{})
+}
+
+func (r *NamespacedRESTReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.ControllerClient = mgr.GetClient()
 	r.Events = mgr.GetEventRecorderFor("template-operator")
 
+	list := func(ctx context.Context, namespace string) ([]templatev1.RESTObject, error) {
+		rests := &templatev1.NamespacedRESTList{}
+		if err := r.ControllerClient.List(ctx, rests, client.InNamespace(namespace)); err != nil {
+			return nil, err
+		}
+		objects := []templatev1.RESTObject{}
+		for i := range rests.Items {
+			objects = append(objects, &rests.Items[i])
+		}
+		return objects, nil
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&templatev1.REST{}).
+		For(&templatev1.NamespacedREST{}).
+		WatchesMetadata(&v1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.referencedBy(list, true))).
+		WatchesMetadata(&v1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.referencedBy(list, false))).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
 
 func incRESTSuccess(name string) {
-	restCount.WithLabelValues(name).Inc()
-	restSuccess.WithLabelValues(name).Inc()
+	k8s.ObserveRESTRun(name, false)
 }
 
 func incRESTFailed(name string) {
-	restCount.WithLabelValues(name).Inc()
-	restFailed.WithLabelValues(name).Inc()
-}
-
-func setRestStatus(rest *templatev1.REST) {
-	rest.Status["lastUpdated"] = metav1.Now().String()
+	k8s.ObserveRESTRun(name, true)
 }
 
-func cloneMap(m map[string]string) map[string]string {
-	x := map[string]string{}
-	for k, v := range m {
-		x[k] = v
-	}
-	return x
+func setRESTCondition(rest templatev1.RESTObject, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&rest.GetStatus().Conditions, metav1.Condition{
+		Type:               templatev1.RESTConditionReady,
+		Status:             status,
+		ObservedGeneration: rest.GetGeneration(),
+		Reason:             reason,
+		Message:            message,
+	})
 }
@@ -18,50 +18,65 @@ package controllers
 
 import (
 	"context"
+	"reflect"
+	"sync"
+	"time"
 
 	templatev1 "github.com/flanksource/template-operator/api/v1"
 	"github.com/flanksource/template-operator/k8s"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
-var (
-	templateCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "template_operator_template_count",
-			Help: "Total template runs count",
-		},
-		[]string{"template"},
-	)
-	templateSuccess = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "template_operator_template_success",
-			Help: "Total successful template runs count",
-		},
-		[]string{"template"},
-	)
-	templateFailed = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "template_operator_template_failed",
-			Help: "Total failed template runs count",
-		},
-		[]string{"template"},
-	)
-)
+// TemplateReconciler reconciles a Template object, handing each of its sources to a
+// queue so that they are reconciled independently
+type TemplateReconciler struct {
+	Client
+	MaxConcurrentReconciles int
+	// SourceWorkers is the number of sources reconciled concurrently
+	SourceWorkers int
+	// ApplyWorkers is the number of generated objects applied concurrently per source
+	ApplyWorkers int
+	// RevisionHistoryLimit is the number of TemplateRevisions kept for each template
+	RevisionHistoryLimit int
+	// SyncPeriod is the interval at which templates are reconciled again, status
+	// updates do not trigger a reconcile
+	SyncPeriod time.Duration
+	// RateLimiter is shared with the REST reconcilers to limit the rate of http
+	// requests per host, including the requests sent for each source
+	RateLimiter *k8s.HostRateLimiter
 
-func init() {
-	metrics.Registry.MustRegister(templateCount, templateSuccess, templateFailed)
+	sources *sourceQueue
+	status  *statusWriter
+	runsMtx sync.Mutex
+	// runs holds the template manager of each template, prepared by Reconcile for the
+	// current generation and shared by the sources of the template
+	runs map[string]*templateRun
+	// states holds the state of the sources of each template, kept across generations
+	states map[string]*k8s.SourceStates
 }
 
-// TemplateReconciler reconciles a Template object
-type TemplateReconciler struct {
-	Client
+// templateRun is the template manager prepared for a generation of a template, and
+// the template applied to its sources, i.e. with the pinned revision applied
+type templateRun struct {
+	tm       *k8s.TemplateManager
+	template *templatev1.Template
 }
 
 // +kubebuilder:rbac:groups="*",resources="*",verbs="*"
@@ -69,27 +84,49 @@ type TemplateReconciler struct {
 func (r *TemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("template", req.NamespacedName)
 	name := req.NamespacedName.String()
+	ctx, span := tracer.Start(ctx, "TemplateReconciler.Reconcile", trace.WithAttributes(attribute.String("template", name)))
+	defer span.End()
 
 	template := &templatev1.Template{}
 	if err := r.ControllerClient.Get(ctx, req.NamespacedName, template); err != nil {
 		if kerrors.IsNotFound(err) {
 			log.Error(err, "template not found")
+			r.setRun(req.Name, nil)
+			r.deleteStates(req.Name)
 			return reconcile.Result{}, nil
 		}
 		log.Error(err, "failed to get template")
 		incFailed(name)
 		return reconcile.Result{}, err
 	}
-	//If the TemplateManager will fetch a new schema, ensure the kommons.client also does so in order to ensure they contain the same information
-	if r.Cache.SchemaHasExpired() {
-		r.KommonsClient.ResetRestMapper()
+	if err := r.updateSuspended(ctx, template); err != nil {
+		log.Error(err, "failed to update suspended condition")
 	}
-	tm, err := k8s.NewTemplateManager(r.KommonsClient, log, r.Cache, r.Events, r.Watcher)
+	if template.Spec.Suspend {
+		log.V(2).Info("template is suspended, skipping")
+		r.setRun(template.Name, nil)
+		return reconcile.Result{}, nil
+	}
+	if err := r.ensureRevision(ctx, template); err != nil {
+		log.Error(err, "failed to record template revision")
+		incFailed(name)
+		return reconcile.Result{}, err
+	}
+	run, err := r.newRun(ctx, template)
 	if err != nil {
+		log.Error(err, "failed to prepare template")
 		incFailed(name)
 		return reconcile.Result{}, err
 	}
-	result, err := tm.Run(ctx, template, r.reconcileObject(req.NamespacedName))
+	r.setRun(template.Name, run)
+	tm := run.tm
+	// the sources of a new batch are only enqueued once it is recorded in the status
+	rollout := template.Status.Rollout.DeepCopy()
+	tm.PersistRollout = func(ctx context.Context, template *templatev1.Template) error {
+		return errors.Wrap(r.updateRollout(ctx, template, rollout), "failed to update rollout status")
+	}
+	result, err := tm.Run(ctx, template, r.enqueueSource(template.Name))
+	r.status.Add(template.Name)
 	if err != nil {
 		incFailed(name)
 		return reconcile.Result{}, err
@@ -101,76 +138,303 @@ func (r *TemplateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 func (r *TemplateReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.ControllerClient = mgr.GetClient()
 	r.Events = mgr.GetEventRecorderFor("template-operator")
+	r.runs = map[string]*templateRun{}
+	r.states = map[string]*k8s.SourceStates{}
+	r.sources = newSourceQueue(r.handleSource, r.SourceWorkers, r.Log.WithName("sources"))
+	if err := mgr.Add(r.sources); err != nil {
+		return err
+	}
+	r.status = newStatusWriter(r.writeStatus, r.Log.WithName("status"))
+	if err := mgr.Add(r.status); err != nil {
+		return err
+	}
 
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&templatev1.Template{}).
+		// status only records the state of sources and must not trigger a new run
+		For(&templatev1.Template{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
 
-func (r *TemplateReconciler) reconcileObject(namespacedName types.NamespacedName) k8s.CallbackFunc {
+// enqueueSource returns a callback adding sources of the template to the source queue,
+// used both when listing sources and by the watcher
+func (r *TemplateReconciler) enqueueSource(template string) k8s.CallbackFunc {
 	return func(obj unstructured.Unstructured) error {
-		ctx := context.Background()
-		log := r.Log.WithValues("template", namespacedName)
-		name := namespacedName.String()
-		template := &templatev1.Template{}
-		if err := r.ControllerClient.Get(ctx, namespacedName, template); err != nil {
-			if kerrors.IsNotFound(err) {
-				log.Error(err, "template not found")
-				return err
+		r.sources.Add(newTemplateSource(template, obj))
+		return nil
+	}
+}
+
+// handleSource reconciles a single source object of a Template with the run prepared
+// by Reconcile, its state is counted in the status of the template by the status writer
+func (r *TemplateReconciler) handleSource(ctx context.Context, key templateSource) (ctrl.Result, error) {
+	log := r.Log.WithValues("template", key.Template, "kind", key.Kind, "namespace", key.Namespace, "name", key.Name)
+	name := key.Template
+	// sources are added again by Reconcile once the template is prepared or resumed
+	run := r.getRun(name)
+	if run == nil {
+		log.V(2).Info("template is not prepared or suspended, skipping source")
+		return ctrl.Result{}, nil
+	}
+	tm := run.tm
+	template := run.template.DeepCopy()
+
+	// sources are added again once their rollout batch starts
+	sourceKey := k8s.SourceKey(key.Kind, key.Namespace, key.Name)
+	if !tm.RolloutAllows(template, sourceKey) {
+		log.V(2).Info("source is waiting for a later rollout batch, skipping")
+		return ctrl.Result{}, nil
+	}
+
+	namespaces, err := tm.GetSourceNamespaces(ctx, template)
+	if err != nil {
+		log.Error(err, "failed to get source namespaces")
+		incFailed(name)
+		return ctrl.Result{}, err
+	}
+	if len(namespaces) != 1 || namespaces[0] != v1.NamespaceAll {
+		found := false
+		for _, n := range namespaces {
+			if n == key.Namespace {
+				found = true
+				break
 			}
-			log.Error(err, "failed to get template")
-			incFailed(name)
-			return err
 		}
+		if !found {
+			log.V(2).Info("Namespace not found in source namespaces", "namespaces", namespaces)
+			tm.States.Delete(sourceKey)
+			r.status.Add(name)
+			return ctrl.Result{}, nil
+		}
+	}
 
-		//If the TemplateManager will fetch a new schema, ensure the kommons.client also does so in order to ensure they contain the same information
-		if r.Cache.SchemaHasExpired() {
-			r.KommonsClient.ResetRestMapper()
+	client, err := k8s.ResourceClient(r.KommonsClient, key.APIVersion, key.Kind)
+	if err != nil {
+		incFailed(name)
+		return ctrl.Result{}, errors.Wrapf(err, "failed to get dynamic client for %s %s", key.APIVersion, key.Kind)
+	}
+	source, err := client.Namespace(key.Namespace).Get(ctx, key.Name, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			log.V(2).Info("source not found, skipping")
+			tm.States.Delete(sourceKey)
+			r.status.Add(name)
+			return ctrl.Result{}, nil
 		}
-		tm, err := k8s.NewTemplateManager(r.KommonsClient, log, r.Cache, r.Events, r.Watcher)
-		if err != nil {
-			log.Error(err, "failed to create template manager")
-			incFailed(name)
-			return err
+		incFailed(name)
+		return ctrl.Result{}, errors.Wrap(err, "failed to get source")
+	}
+
+	result, err := tm.HandleSource(ctx, template, *source)
+	r.status.Add(name)
+	if err != nil {
+		incFailed(name)
+		return result, err
+	}
+	incSuccess(name)
+	return result, nil
+}
+
+// newRun creates the template manager for the current generation of template, shared
+// by all of its sources until the next generation
+func (r *TemplateReconciler) newRun(ctx context.Context, template *templatev1.Template) (*templateRun, error) {
+	log := r.Log.WithValues("template", template.Name)
+	//If the TemplateManager will fetch a new schema, ensure the kommons.client also does so in order to ensure they contain the same information
+	if r.Cache.SchemaHasExpired() {
+		r.KommonsClient.ResetRestMapper()
+	}
+	tm, err := k8s.NewTemplateManager(r.KommonsClient, log, r.Cache, r.Events, r.Watcher)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create template manager")
+	}
+	tm.Workers = r.ApplyWorkers
+	tm.ResyncPeriod = r.SyncPeriod
+	tm.RESTManager.RateLimiter = r.RateLimiter
+
+	rules := &templatev1.ReadinessRuleList{}
+	if err := r.ControllerClient.List(ctx, rules); err != nil && !meta.IsNoMatchError(err) {
+		return nil, errors.Wrap(err, "failed to list readiness rules")
+	}
+	tm.ReadinessRules = rules.Items
+
+	tm.States = r.sourceStates(template)
+
+	// a pinned revision replaces the rendering fields of the spec
+	var pinned *templatev1.TemplateRevision
+	if template.Spec.Revision != "" {
+		pinned = &templatev1.TemplateRevision{}
+		if err := r.ControllerClient.Get(ctx, types.NamespacedName{Name: k8s.RevisionName(template.Name, template.Spec.Revision)}, pinned); err != nil {
+			return nil, errors.Wrapf(err, "failed to get revision %s", template.Spec.Revision)
 		}
+	}
+	effective, revision, err := k8s.EffectiveTemplate(template, pinned)
+	if err != nil {
+		return nil, err
+	}
+	tm.Revision = revision
+	return &templateRun{tm: tm, template: effective}, nil
+}
+
+func (r *TemplateReconciler) getRun(template string) *templateRun {
+	r.runsMtx.Lock()
+	defer r.runsMtx.Unlock()
+	return r.runs[template]
+}
 
-		namespaces, err := tm.GetSourceNamespaces(ctx, template)
-		if err != nil {
-			log.Error(err, "failed to get source namespaces")
-			incFailed(name)
-			return err
+// setRun replaces the run of template, a nil run removes it
+func (r *TemplateReconciler) setRun(template string, run *templateRun) {
+	r.runsMtx.Lock()
+	defer r.runsMtx.Unlock()
+	if run == nil {
+		delete(r.runs, template)
+	} else {
+		r.runs[template] = run
+	}
+}
+
+// sourceStates returns the states of the sources of template, restored from its status
+// after the operator restarts
+func (r *TemplateReconciler) sourceStates(template *templatev1.Template) *k8s.SourceStates {
+	r.runsMtx.Lock()
+	defer r.runsMtx.Unlock()
+	states, found := r.states[template.Name]
+	if !found {
+		states = k8s.NewSourceStates()
+		states.RestoreBlocked(template.Status.Blocked)
+		states.RestoreRevisions(template.Status.Sources)
+		r.states[template.Name] = states
+	}
+	return states
+}
+
+func (r *TemplateReconciler) deleteStates(template string) {
+	r.runsMtx.Lock()
+	defer r.runsMtx.Unlock()
+	delete(r.states, template)
+}
+
+// writeStatus writes the summary of the states of the sources of template, the lists of
+// blocked resources and of sources on other revisions, and its Conflict condition, in a
+// single update
+func (r *TemplateReconciler) writeStatus(ctx context.Context, name string) error {
+	r.runsMtx.Lock()
+	states := r.states[name]
+	run := r.runs[name]
+	r.runsMtx.Unlock()
+	if states == nil {
+		return nil
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		template := &templatev1.Template{}
+		if err := r.ControllerClient.Get(ctx, types.NamespacedName{Name: name}, template); err != nil {
+			return client.IgnoreNotFound(err)
 		}
-		if len(namespaces) != 1 || namespaces[0] != v1.NamespaceAll {
-			found := false
-			for _, n := range namespaces {
-				if n == obj.GetNamespace() {
-					found = true
-					break
-				}
-			}
-			if !found {
-				log.V(2).Info("Namespace %s not found in namespaces %v\n", obj.GetNamespace(), namespaces)
-				return nil
-			}
+		revision := template.Status.Revision
+		if run != nil && run.template.Generation == template.Generation {
+			revision = run.tm.Revision
 		}
+		summary := states.Summary(revision)
 
-		_, err = tm.HandleSource(ctx, template, obj)
-		if err != nil {
-			incFailed(name)
-			return err
+		status := template.Status.DeepCopy()
+		status.Summary = &summary
+		status.Blocked = states.Blocked(templatev1.MaxStatusEntries)
+		status.Sources = states.Revisions(revision, templatev1.MaxStatusEntries)
+		meta.SetStatusCondition(&status.Conditions, k8s.ConflictCondition(template.Generation, summary))
+		if equality.Semantic.DeepEqual(status, &template.Status) {
+			return nil
 		}
-		incSuccess(name)
+		template.Status = *status
+		return r.ControllerClient.Status().Update(ctx, template)
+	})
+}
 
+// updateRollout writes the rollout status of template if it changed from old
+func (r *TemplateReconciler) updateRollout(ctx context.Context, template *templatev1.Template, old *templatev1.TemplateRolloutStatus) error {
+	if reflect.DeepEqual(old, template.Status.Rollout) {
 		return nil
 	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &templatev1.Template{}
+		if err := r.ControllerClient.Get(ctx, types.NamespacedName{Name: template.Name}, latest); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		latest.Status.Rollout = template.Status.Rollout.DeepCopy()
+		return r.ControllerClient.Status().Update(ctx, latest)
+	})
+}
+
+// ensureRevision records the current spec of template as a TemplateRevision, sets it
+// as the revision of the template and prunes the revisions beyond the history limit
+func (r *TemplateReconciler) ensureRevision(ctx context.Context, template *templatev1.Template) error {
+	revision, err := k8s.NewTemplateRevision(template)
+	if err != nil {
+		return err
+	}
+	if err := controllerutil.SetOwnerReference(template, revision, r.Scheme); err != nil {
+		return errors.Wrap(err, "failed to set owner of revision")
+	}
+	if err := r.ControllerClient.Create(ctx, revision); err != nil && !kerrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create revision %s", revision.Name)
+	}
+	if err := r.pruneRevisions(ctx, template, revision.Spec.Revision); err != nil {
+		return err
+	}
+	if template.Status.Revision == revision.Spec.Revision {
+		return nil
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &templatev1.Template{}
+		if err := r.ControllerClient.Get(ctx, types.NamespacedName{Name: template.Name}, latest); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		latest.Status.Revision = revision.Spec.Revision
+		return r.ControllerClient.Status().Update(ctx, latest)
+	})
+}
+
+// pruneRevisions deletes the oldest revisions of template beyond the history limit,
+// keeping the current and pinned revisions
+func (r *TemplateReconciler) pruneRevisions(ctx context.Context, template *templatev1.Template, current string) error {
+	if r.RevisionHistoryLimit <= 0 {
+		return nil
+	}
+	revisions := &templatev1.TemplateRevisionList{}
+	if err := r.ControllerClient.List(ctx, revisions, client.MatchingLabels{templatev1.TemplateNameLabel: template.Name}); err != nil {
+		return errors.Wrap(err, "failed to list revisions")
+	}
+	prune := k8s.RevisionsToPrune(revisions.Items, r.RevisionHistoryLimit, current, template.Spec.Revision)
+	for i := range prune {
+		revision := &prune[i]
+		r.Log.V(2).Info("deleting revision", "template", template.Name, "revision", revision.Spec.Revision)
+		if err := r.ControllerClient.Delete(ctx, revision); client.IgnoreNotFound(err) != nil {
+			return errors.Wrapf(err, "failed to delete revision %s", revision.Name)
+		}
+	}
+	return nil
+}
+
+// updateSuspended sets the Suspended condition of template from spec.suspend
+func (r *TemplateReconciler) updateSuspended(ctx context.Context, template *templatev1.Template) error {
+	condition := k8s.SuspendedCondition(template)
+	if condition == nil {
+		return nil
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &templatev1.Template{}
+		if err := r.ControllerClient.Get(ctx, types.NamespacedName{Name: template.Name}, latest); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		meta.SetStatusCondition(&latest.Status.Conditions, *condition)
+		return r.ControllerClient.Status().Update(ctx, latest)
+	})
 }
 
 func incSuccess(name string) {
-	templateCount.WithLabelValues(name).Inc()
-	templateSuccess.WithLabelValues(name).Inc()
+	k8s.ObserveTemplateRun(name, false)
 }
 
 func incFailed(name string) {
-	templateCount.WithLabelValues(name).Inc()
-	templateFailed.WithLabelValues(name).Inc()
+	k8s.ObserveTemplateRun(name, true)
 }
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// templateSource identifies a source object of a Template in the source queue
+type templateSource struct {
+	Template   string
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+}
+
+func newTemplateSource(template string, obj unstructured.Unstructured) templateSource {
+	return templateSource{
+		Template:   template,
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+}
+
+// sourceQueue handles each source object of a Template independently, so that a
+// failing source does not block the others and is retried with its own backoff
+type sourceQueue struct {
+	queue   workqueue.RateLimitingInterface
+	handle  func(ctx context.Context, source templateSource) (ctrl.Result, error)
+	workers int
+	log     logr.Logger
+}
+
+func newSourceQueue(handle func(ctx context.Context, source templateSource) (ctrl.Result, error), workers int, log logr.Logger) *sourceQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &sourceQueue{
+		queue: workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{
+			Name: "template-source",
+		}),
+		handle:  handle,
+		workers: workers,
+		log:     log,
+	}
+}
+
+func (q *sourceQueue) Add(source templateSource) {
+	q.queue.Add(source)
+}
+
+// Start processes the queue with the configured number of workers until ctx is
+// cancelled, it is added to the manager as a Runnable. A source is never handled
+// by more than one worker at a time
+func (q *sourceQueue) Start(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		q.queue.ShutDown()
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q.processNext(ctx) {
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (q *sourceQueue) processNext(ctx context.Context) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	source := item.(templateSource)
+	result, err := q.handle(ctx, source)
+	switch {
+	case err != nil:
+		q.log.Error(err, "failed to handle source, requeueing", "template", source.Template, "kind", source.Kind, "namespace", source.Namespace, "name", source.Name)
+		q.queue.AddRateLimited(item)
+	case result.RequeueAfter > 0:
+		q.queue.Forget(item)
+		q.queue.AddAfter(item, result.RequeueAfter)
+	case result.Requeue:
+		q.queue.AddRateLimited(item)
+	default:
+		q.queue.Forget(item)
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// statusWriteDelay is the time status changes of a template are collected for before
+// its status is written
+const statusWriteDelay = 2 * time.Second
+
+// statusWriter writes the status of templates in batches: however many sources of a
+// template are handled within statusWriteDelay, its status is written once
+type statusWriter struct {
+	queue workqueue.RateLimitingInterface
+	write func(ctx context.Context, template string) error
+	log   logr.Logger
+}
+
+func newStatusWriter(write func(ctx context.Context, template string) error, log logr.Logger) *statusWriter {
+	return &statusWriter{
+		queue: workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{
+			Name: "template-status",
+		}),
+		write: write,
+		log:   log,
+	}
+}
+
+// Add schedules a write of the status of template, pending writes are merged
+func (w *statusWriter) Add(template string) {
+	w.queue.AddAfter(template, statusWriteDelay)
+}
+
+// Start writes statuses until ctx is cancelled, it is added to the manager as a Runnable
+func (w *statusWriter) Start(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		w.queue.ShutDown()
+	}()
+
+	for w.processNext(ctx) {
+	}
+	return nil
+}
+
+func (w *statusWriter) processNext(ctx context.Context) bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+
+	template := item.(string)
+	if err := w.write(ctx, template); err != nil {
+		w.log.Error(err, "failed to write status", "template", template)
+		w.queue.AddRateLimited(item)
+		return true
+	}
+	w.queue.Forget(item)
+	return true
+}
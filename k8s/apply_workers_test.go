@@ -0,0 +1,120 @@
+package k8s_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("ApplyWorkers", func() {
+	It("Applies independent objects with at most the configured number of workers", func() {
+		var objs []unstructured.Unstructured
+		for i := 0; i < 12; i++ {
+			objs = append(objs, dependent(fmt.Sprintf("cm-%d", i), ""))
+		}
+
+		var active, max, applied int32
+		pending, err := k8s.ApplyLevels(3, objs, func(name string) (bool, error) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&applied, 1)
+			return true, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+		Expect(atomic.LoadInt32(&applied)).To(Equal(int32(12)))
+		Expect(atomic.LoadInt32(&max)).To(Equal(int32(3)))
+	})
+
+	It("Applies each level once the previous levels are applied", func() {
+		objs := []unstructured.Unstructured{
+			dependent("app", "app", "db", "cache"),
+			dependent("db", "db"),
+			dependent("cache", "cache", "db"),
+		}
+		for i := 0; i < 6; i++ {
+			objs = append(objs, dependent(fmt.Sprintf("cm-%d", i), ""))
+		}
+
+		var mtx sync.Mutex
+		applied := map[string]bool{}
+		var violations []string
+		dependencies := map[string][]string{"app": {"db", "cache"}, "cache": {"db"}}
+		pending, err := k8s.ApplyLevels(4, objs, func(name string) (bool, error) {
+			mtx.Lock()
+			for _, d := range dependencies[name] {
+				if !applied[d] {
+					violations = append(violations, fmt.Sprintf("%s applied before %s", name, d))
+				}
+			}
+			mtx.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			applied[name] = true
+			return true, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+		Expect(violations).To(BeEmpty())
+		Expect(applied).To(HaveLen(9))
+	})
+
+	It("Reports the errors of all concurrent applies and stops applying", func() {
+		objs := []unstructured.Unstructured{
+			dependent("a", ""),
+			dependent("b", ""),
+			dependent("c", "c"),
+			dependent("d", "", "c"),
+		}
+
+		var mtx sync.Mutex
+		var applied []string
+		_, err := k8s.ApplyLevels(2, objs, func(name string) (bool, error) {
+			mtx.Lock()
+			applied = append(applied, name)
+			mtx.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+			if name == "a" || name == "b" {
+				return false, fmt.Errorf("%s failed", name)
+			}
+			return true, nil
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("a failed"))
+		Expect(err.Error()).To(ContainSubstring("b failed"))
+		Expect(applied).To(ConsistOf("a", "b"))
+	})
+
+	It("Does not apply objects depending on objects that are not ready", func() {
+		objs := []unstructured.Unstructured{
+			dependent("db", "db"),
+			dependent("app", "app", "db"),
+		}
+
+		var applied []string
+		pending, err := k8s.ApplyLevels(2, objs, func(name string) (bool, error) {
+			applied = append(applied, name)
+			return false, nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(applied).To(Equal([]string{"db"}))
+		Expect(pending).To(HaveLen(2))
+	})
+})
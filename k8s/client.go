@@ -0,0 +1,34 @@
+package k8s
+
+import (
+	"github.com/flanksource/kommons"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// ResourceClient returns the dynamic client of the resource with apiVersion and kind.
+// Kinds served by several groups are only resolved by the apiVersion, the kind alone
+// is used if apiVersion is empty
+func ResourceClient(c *kommons.Client, apiVersion, kind string) (dynamic.NamespaceableResourceInterface, error) {
+	if apiVersion == "" {
+		return c.GetClientByKind(kind)
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid apiVersion %s", apiVersion)
+	}
+	rm, err := c.GetRestMapper()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get rest mapper")
+	}
+	mapping, err := rm.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: kind}, gv.Version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get rest mapping for %s %s", apiVersion, kind)
+	}
+	dynamicClient, err := c.GetDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dynamic client")
+	}
+	return dynamicClient.Resource(mapping.Resource), nil
+}
@@ -0,0 +1,338 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const defaultDependencyInterval = 2 * time.Minute
+
+// dependency is an entry of the depends field of a generated resource, either the id
+// of another resource or an object with an id and optional interval and timeout
+type dependency struct {
+	ID       string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// dependencyNode is a generated resource with its id, depends and readiness fields removed
+type dependencyNode struct {
+	ID      string
+	Object  unstructured.Unstructured
+	Depends []dependency
+	// Readiness overrides the readiness check of the resource
+	Readiness *templatev1.Readiness
+	// Raw is the template of a resource depending on others, it is rendered into
+	// Object once its dependencies are ready so that it can reference them
+	Raw []byte
+	// Empty is set if Raw was rendered into no object
+	Empty bool
+}
+
+// dependencyGraph orders the resources generated for a source so that each resource
+// is applied after the resources it depends on
+type dependencyGraph struct {
+	// Levels holds the nodes in topological order, the nodes of a level only depend
+	// on nodes of previous levels and may be applied concurrently
+	Levels [][]*dependencyNode
+	// IDs holds the nodes with an id
+	IDs map[string]*dependencyNode
+}
+
+// newDependencyGraph builds the graph of the rendered objs and the dependent resource
+// templates, removing the id, depends and readiness fields from each object. It fails on
+// duplicate or unknown ids and on dependency cycles
+func newDependencyGraph(objs []unstructured.Unstructured, dependent []runtime.RawExtension, defaults *templatev1.TemplateDependencies) (*dependencyGraph, error) {
+	var nodes []*dependencyNode
+	ids := map[string]*dependencyNode{}
+	add := func(node *dependencyNode) error {
+		if node.ID != "" {
+			if _, found := ids[node.ID]; found {
+				return errors.Errorf("duplicate resource id %s", node.ID)
+			}
+			ids[node.ID] = node
+		}
+		nodes = append(nodes, node)
+		return nil
+	}
+
+	for i := range objs {
+		node, err := newDependencyNode(objs[i], defaults)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(node); err != nil {
+			return nil, err
+		}
+	}
+	for _, resource := range dependent {
+		obj := unstructured.Unstructured{}
+		if err := json.Unmarshal(resource.Raw, &obj.Object); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal resource")
+		}
+		node, err := newDependencyNode(obj, defaults)
+		if err != nil {
+			return nil, err
+		}
+		// only the type is known until the resource is rendered
+		node.Object = unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": obj.GetAPIVersion(),
+			"kind":       obj.GetKind(),
+		}}
+		node.Raw = resource.Raw
+		if err := add(node); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, node := range nodes {
+		for _, d := range node.Depends {
+			if _, found := ids[d.ID]; !found {
+				return nil, errors.Errorf("%s depends on unknown resource id %s", node, d.ID)
+			}
+		}
+	}
+	if cycle := findCycle(nodes, ids); cycle != nil {
+		return nil, errors.Errorf("dependency cycle between resources: %s", strings.Join(cycle, " -> "))
+	}
+
+	graph := &dependencyGraph{IDs: ids}
+	level := map[*dependencyNode]int{}
+	for len(level) < len(nodes) {
+		var current []*dependencyNode
+		for _, node := range nodes {
+			if _, done := level[node]; done {
+				continue
+			}
+			ready := true
+			for _, d := range node.Depends {
+				if l, done := level[ids[d.ID]]; !done || l == len(graph.Levels) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				current = append(current, node)
+			}
+		}
+		for _, node := range current {
+			level[node] = len(graph.Levels)
+		}
+		graph.Levels = append(graph.Levels, current)
+	}
+	return graph, nil
+}
+
+// hasDepends returns whether the resource template raw has a depends field
+func hasDepends(raw []byte) (bool, error) {
+	resource := struct {
+		Depends interface{} `json:"depends"`
+	}{}
+	if err := json.Unmarshal(raw, &resource); err != nil {
+		return false, errors.Wrap(err, "failed to unmarshal resource")
+	}
+	return resource.Depends != nil, nil
+}
+
+func newDependencyNode(obj unstructured.Unstructured, defaults *templatev1.TemplateDependencies) (*dependencyNode, error) {
+	node := &dependencyNode{Object: obj}
+	if id, found := obj.Object["id"]; found {
+		s, ok := id.(string)
+		if !ok || s == "" {
+			return nil, errors.Errorf("id of %s must be a non empty string", node)
+		}
+		node.ID = s
+	}
+
+	interval, timeout := defaultDependencyInterval, time.Duration(0)
+	if defaults != nil && defaults.Interval != nil {
+		interval = defaults.Interval.Duration
+	}
+	if defaults != nil && defaults.Timeout != nil {
+		timeout = defaults.Timeout.Duration
+	}
+
+	if depends, found := obj.Object["depends"]; found {
+		items, ok := depends.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("depends of %s must be a list", node)
+		}
+		for _, item := range items {
+			d := dependency{Interval: interval, Timeout: timeout}
+			switch v := item.(type) {
+			case string:
+				d.ID = v
+			case map[string]interface{}:
+				d.ID = fmt.Sprint(v["id"])
+				for field, duration := range map[string]*time.Duration{"interval": &d.Interval, "timeout": &d.Timeout} {
+					if v[field] == nil {
+						continue
+					}
+					parsed, err := time.ParseDuration(fmt.Sprint(v[field]))
+					if err != nil {
+						return nil, errors.Wrapf(err, "invalid %s of dependency %s of %s", field, d.ID, node)
+					}
+					*duration = parsed
+				}
+			default:
+				d.ID = fmt.Sprint(v)
+			}
+			node.Depends = append(node.Depends, d)
+		}
+	}
+
+	if readiness, found := obj.Object["readiness"]; found {
+		js, err := json.Marshal(readiness)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal readiness of %s", node)
+		}
+		node.Readiness = &templatev1.Readiness{}
+		if err := json.Unmarshal(js, node.Readiness); err != nil {
+			return nil, errors.Wrapf(err, "invalid readiness of %s", node)
+		}
+	}
+
+	stripDependencyFields(&node.Object)
+	return node, nil
+}
+
+// stripDependencyFields removes the fields of a generated resource that are only
+// used by the template operator
+func stripDependencyFields(obj *unstructured.Unstructured) {
+	delete(obj.Object, "id")
+	delete(obj.Object, "depends")
+	delete(obj.Object, "readiness")
+}
+
+// blockedOn returns the blocked entry of node if any of its dependencies is not ready,
+// along with the interval after which they should be checked again. The time the
+// node started waiting is kept from its previous entry
+func blockedOn(node *dependencyNode, ready map[string]bool, source string, previous []BlockedResource) (*BlockedResource, time.Duration) {
+	entry := &BlockedResource{
+		Source:    source,
+		ID:        node.ID,
+		Kind:      node.Object.GetKind(),
+		Namespace: node.Object.GetNamespace(),
+		Name:      node.Object.GetName(),
+		Since:     metav1.Now(),
+	}
+	for _, p := range previous {
+		if p.sameResource(*entry) {
+			entry.Since = p.Since
+		}
+	}
+
+	var requeueAfter time.Duration
+	for _, d := range node.Depends {
+		if ready[d.ID] {
+			continue
+		}
+		entry.WaitingFor = append(entry.WaitingFor, d.ID)
+		if requeueAfter == 0 || d.Interval < requeueAfter {
+			requeueAfter = d.Interval
+		}
+		if d.Timeout > 0 && time.Since(entry.Since.Time) > d.Timeout {
+			entry.TimedOut = true
+		}
+	}
+	if len(entry.WaitingFor) == 0 {
+		return nil, 0
+	}
+	return entry, requeueAfter
+}
+
+// isBlocked returns whether the resource of entry is in blocked
+func isBlocked(blocked []BlockedResource, entry BlockedResource) bool {
+	for _, b := range blocked {
+		if b.sameResource(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameResource returns whether b and other are entries of the same resource. Resources
+// are matched by id, as resources depending on others are only named once rendered
+func (b BlockedResource) sameResource(other BlockedResource) bool {
+	if b.ID != "" || other.ID != "" {
+		return b.ID == other.ID
+	}
+	return b.Kind == other.Kind && b.Namespace == other.Namespace && b.Name == other.Name
+}
+
+func (b BlockedResource) String() string {
+	return resourceString(b.Kind, b.Namespace, b.Name, b.ID)
+}
+
+// findCycle returns the ids forming a dependency cycle, if any
+func findCycle(nodes []*dependencyNode, ids map[string]*dependencyNode) []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[*dependencyNode]int{}
+	var path []string
+
+	var visit func(node *dependencyNode) []string
+	visit = func(node *dependencyNode) []string {
+		state[node] = visiting
+		path = append(path, node.ID)
+		for _, d := range node.Depends {
+			next := ids[d.ID]
+			switch state[next] {
+			case visiting:
+				for i, id := range path {
+					if id == next.ID {
+						return append(append([]string{}, path[i:]...), next.ID)
+					}
+				}
+			case 0:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[node] = visited
+		return nil
+	}
+
+	for _, node := range nodes {
+		if state[node] == 0 {
+			if cycle := visit(node); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+func (n *dependencyNode) String() string {
+	return resourceString(n.Object.GetKind(), n.Object.GetNamespace(), n.Object.GetName(), n.ID)
+}
+
+// resourceString describes a generated resource, resources that are not rendered
+// yet only have a kind and an id
+func resourceString(kind, namespace, name, id string) string {
+	s := kind
+	if name != "" {
+		s = fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+	}
+	if id != "" {
+		s += fmt.Sprintf(" (id=%s)", id)
+	}
+	return s
+}
+
+// SourceKey identifies a source object of a Template
+func SourceKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
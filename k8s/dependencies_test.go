@@ -0,0 +1,132 @@
+package k8s_test
+
+import (
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func dependent(name, id string, depends ...interface{}) unstructured.Unstructured {
+	obj := unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+	}}
+	if id != "" {
+		obj.Object["id"] = id
+	}
+	if len(depends) > 0 {
+		obj.Object["depends"] = depends
+	}
+	return obj
+}
+
+var _ = Describe("Dependencies", func() {
+	It("Orders resources in levels after the resources they depend on", func() {
+		levels, err := k8s.DependencyLevels([]unstructured.Unstructured{
+			dependent("app", "app", "db", "cache"),
+			dependent("db", "db"),
+			dependent("standalone", ""),
+			dependent("cache", "cache", "db"),
+			dependent("dashboard", "", map[string]interface{}{"id": "app"}),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(levels).To(Equal([][]string{
+			{"db", "standalone"},
+			{"cache"},
+			{"app"},
+			{"dashboard"},
+		}))
+	})
+
+	It("Fails on unknown and duplicate ids", func() {
+		_, err := k8s.DependencyLevels([]unstructured.Unstructured{dependent("app", "app", "db")})
+		Expect(err).To(MatchError(ContainSubstring("depends on unknown resource id db")))
+
+		_, err = k8s.DependencyLevels([]unstructured.Unstructured{dependent("a", "db"), dependent("b", "db")})
+		Expect(err).To(MatchError(ContainSubstring("duplicate resource id db")))
+	})
+
+	It("Fails on dependency cycles", func() {
+		_, err := k8s.DependencyLevels([]unstructured.Unstructured{
+			dependent("a", "a", "b"),
+			dependent("b", "b", "c"),
+			dependent("c", "c", "a"),
+			dependent("d", "d"),
+		})
+		Expect(err).To(MatchError("dependency cycle between resources: a -> b -> c -> a"))
+
+		_, err = k8s.DependencyLevels([]unstructured.Unstructured{dependent("self", "self", "self")})
+		Expect(err).To(MatchError("dependency cycle between resources: self -> self"))
+	})
+
+	Describe("BlockedOn", func() {
+		defaults := &templatev1.TemplateDependencies{
+			Interval: &metav1.Duration{Duration: time.Minute},
+			Timeout:  &metav1.Duration{Duration: time.Hour},
+		}
+
+		It("Is not blocked once all dependencies are ready", func() {
+			entry, requeueAfter, err := k8s.BlockedOn(dependent("app", "app", "db"), defaults, map[string]bool{"db": true}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry).To(BeNil())
+			Expect(requeueAfter).To(BeZero())
+		})
+
+		It("Waits for dependencies with the shortest interval", func() {
+			entry, requeueAfter, err := k8s.BlockedOn(dependent("app", "app", "db", map[string]interface{}{"id": "cache", "interval": "10s"}), defaults, map[string]bool{}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry.WaitingFor).To(Equal([]string{"db", "cache"}))
+			Expect(entry.TimedOut).To(BeFalse())
+			Expect(requeueAfter).To(Equal(10 * time.Second))
+		})
+
+		It("Times out from the time it started waiting", func() {
+			previous := []k8s.BlockedResource{{
+				ID:        "app",
+				Kind:      "ConfigMap",
+				Namespace: "default",
+				Name:      "app",
+				Since:     metav1.NewTime(time.Now().Add(-2 * time.Hour)),
+			}}
+			entry, _, err := k8s.BlockedOn(dependent("app", "app", "db"), defaults, map[string]bool{}, previous)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry.TimedOut).To(BeTrue())
+			Expect(entry.Since).To(Equal(previous[0].Since))
+
+			entry, _, err = k8s.BlockedOn(dependent("app", "app", map[string]interface{}{"id": "db", "timeout": "3h"}), defaults, map[string]bool{}, previous)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry.TimedOut).To(BeFalse())
+		})
+
+		It("Matches resources that are not rendered yet by their id", func() {
+			// resources depending on others only have a kind until they are rendered
+			secret := func(id string) unstructured.Unstructured {
+				obj := dependent("", id, "db")
+				obj.SetKind("Secret")
+				unstructured.RemoveNestedField(obj.Object, "metadata")
+				return obj
+			}
+			previous := []k8s.BlockedResource{
+				{ID: "credentials", Kind: "Secret", Since: metav1.NewTime(time.Now().Add(-2 * time.Hour))},
+				{ID: "tls", Kind: "Secret", Since: metav1.NewTime(time.Now().Add(-time.Minute))},
+			}
+
+			entry, _, err := k8s.BlockedOn(secret("tls"), defaults, map[string]bool{}, previous)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry.Since).To(Equal(previous[1].Since))
+			Expect(entry.TimedOut).To(BeFalse())
+			Expect(entry.String()).To(Equal("Secret (id=tls)"))
+
+			entry, _, err = k8s.BlockedOn(secret("credentials"), defaults, map[string]bool{}, previous)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entry.Since).To(Equal(previous[0].Since))
+			Expect(entry.TimedOut).To(BeTrue())
+		})
+	})
+})
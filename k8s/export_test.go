@@ -0,0 +1,203 @@
+package k8s
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/go-logr/logr"
+	"github.com/go-openapi/spec"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// exported for tests in k8s_test
+var (
+	XMLToMap           = xmlToMap
+	RESTTemplateData   = restTemplateData
+	VerifyCallback     = verifyCallback
+	ObserveRESTRequest = observeRESTRequest
+)
+
+// Redact redacts s with a redactor knowing secrets
+func Redact(s string, secrets ...string) string {
+	r := &redactor{}
+	r.add(secrets...)
+	return r.redact(s)
+}
+
+// NewTestSchemaManager returns a schema manager for the definitions of swagger, without CRDs
+func NewTestSchemaManager(swagger *spec.Swagger) *SchemaManager {
+	return &SchemaManager{
+		swagger: swagger,
+		fetchCrdFn: func(context.Context) ([]extv1.CustomResourceDefinition, error) {
+			return nil, nil
+		},
+	}
+}
+
+// RenderHTTPRequest returns the headers and body of the http request of template for
+// source, and the hash recorded once sent. Headers are nil if no request is sent
+func (tm *TemplateManager) RenderHTTPRequest(template *templatev1.Template, source unstructured.Unstructured) (map[string]string, string, string, error) {
+	request, _, hash, err := tm.renderHTTPRequest(template, source.Object, source)
+	if err != nil || request == nil {
+		return nil, "", hash, err
+	}
+	return request.Headers, request.Body, hash, nil
+}
+
+// SendHTTPRequest sends the http request of template for source through the REST
+// manager of tm, without writing the response back onto source
+func (tm *TemplateManager) SendHTTPRequest(ctx context.Context, template *templatev1.Template, source unstructured.Unstructured) error {
+	request, _, _, err := tm.renderHTTPRequest(template, source.Object, source)
+	if err != nil || request == nil {
+		return err
+	}
+	_, err = tm.RESTManager.doRequest(ctx, request)
+	return err
+}
+
+// ValidateHTTPOutputs validates the status fields of the http action of template for source
+func (tm *TemplateManager) ValidateHTTPOutputs(template *templatev1.Template, source unstructured.Unstructured) error {
+	return tm.validateHTTPOutputs(source, template.Spec.HTTP.RESTAction)
+}
+
+// ResponseTemplateData returns .response of a response with header and body
+func ResponseTemplateData(header http.Header, body []byte, graphql bool) map[string]interface{} {
+	r := &restResponse{Header: header, Body: body, graphql: graphql}
+	return r.templateData()
+}
+
+// GraphQLError returns the errors of a GraphQL response with body
+func GraphQLError(body []byte) error {
+	r := &restResponse{Body: body}
+	return r.graphqlError()
+}
+
+// SetIdleTimeout sets how long limiters of l are kept after their last use
+func (l *HostRateLimiter) SetIdleTimeout(idle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idleTimeout = idle
+}
+
+// Limiters returns the number of limiters of l
+func (l *HostRateLimiter) Limiters() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// DependencyLevels returns the ids, or names if unset, of the nodes of each level of
+// the dependency graph of objs
+func DependencyLevels(objs []unstructured.Unstructured) ([][]string, error) {
+	graph, err := newDependencyGraph(objs, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var levels [][]string
+	for _, level := range graph.Levels {
+		var names []string
+		for _, node := range level {
+			if node.ID != "" {
+				names = append(names, node.ID)
+			} else {
+				names = append(names, node.Object.GetName())
+			}
+		}
+		levels = append(levels, names)
+	}
+	return levels, nil
+}
+
+// ApplyLevels applies the dependency graph of objs for a source with up to workers
+// concurrent applies, applying each object with apply given its name. It returns the
+// resources that are not ready
+func ApplyLevels(workers int, objs []unstructured.Unstructured, apply func(name string) (bool, error)) ([]string, error) {
+	graph, err := newDependencyGraph(objs, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	tm := &TemplateManager{
+		Log:     logr.Discard(),
+		Events:  record.NewFakeRecorder(len(objs)),
+		Workers: workers,
+		applyNodeFn: func(ctx context.Context, claims *claims, source, target unstructured.Unstructured, graph *dependencyGraph, node *dependencyNode) (bool, error) {
+			return apply(node.Object.GetName())
+		},
+	}
+	source := unstructured.Unstructured{}
+	_, pending, _, err := tm.applyLevels(context.Background(), newClaims(&templatev1.Template{}), source, source, graph, "Source/default/source", nil)
+	return pending, err
+}
+
+// BlockedOn returns the blocked entry of obj given the ready dependencies, and the
+// interval after which to check them again
+func BlockedOn(obj unstructured.Unstructured, defaults *templatev1.TemplateDependencies, ready map[string]bool, previous []BlockedResource) (*BlockedResource, time.Duration, error) {
+	node, err := newDependencyNode(obj, defaults)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry, requeueAfter := blockedOn(node, ready, "Source/default/source", previous)
+	return entry, requeueAfter, nil
+}
+
+// ChangedFields returns the sorted dotted paths of the fields of patched that differ
+// from original
+func ChangedFields(original, patched map[string]interface{}) []string {
+	var fields []string
+	for _, path := range changedFields(original, patched, nil) {
+		fields = append(fields, strings.Join(path, "."))
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// ClaimFields claims the fields of source changed in patched for template, and returns
+// the conflicts found
+func (tm *TemplateManager) ClaimFields(template *templatev1.Template, source unstructured.Unstructured, patched *unstructured.Unstructured) ([]ResourceConflict, error) {
+	c := newClaims(template)
+	err := tm.claimFields(context.Background(), c, source, patched)
+	return c.conflicts, err
+}
+
+// EvaluateReadiness returns whether obj is ready according to readiness, or the rule
+// of its kind if readiness is nil
+func EvaluateReadiness(rules []templatev1.ReadinessRule, obj *unstructured.Unstructured, readiness *templatev1.Readiness) (bool, string, error) {
+	tm := &TemplateManager{ReadinessRules: rules}
+	return tm.evaluateReadiness(obj, tm.readinessFor(obj, readiness))
+}
+
+// SetSourceCondition returns the status conditions of source with the condition
+// conditionType set, and whether it changed
+var SetSourceCondition = setSourceCondition
+
+// SetSourceStatus writes the status of template on source
+func (tm *TemplateManager) SetSourceStatus(template *templatev1.Template, source unstructured.Unstructured, reason, message string) error {
+	return tm.setSourceStatus(context.Background(), template, source, reason, message)
+}
+
+// NextBatch returns the sources not done of the batch with index batch of a rollout
+var NextBatch = nextBatch
+
+// Rollout returns the sources of template to reconcile for its rollout, and updates
+// its rollout status
+func (tm *TemplateManager) Rollout(template *templatev1.Template, sources []unstructured.Unstructured) ([]unstructured.Unstructured, ctrl.Result, error) {
+	return tm.rollout(template, sources)
+}
+
+// SetRevisionLabel labels obj with the revision of tm
+func (tm *TemplateManager) SetRevisionLabel(obj *unstructured.Unstructured) {
+	tm.setRevisionLabel(obj)
+}
+
+// ClaimObject claims obj generated for source for template given its live object, nil
+// if it does not exist, and returns the conflict found
+func (tm *TemplateManager) ClaimObject(template *templatev1.Template, source unstructured.Unstructured, obj, live *unstructured.Unstructured) (*ResourceConflict, error) {
+	return tm.claimLiveObject(context.Background(), newClaims(template), source, obj, live)
+}
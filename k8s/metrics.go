@@ -0,0 +1,135 @@
+package k8s
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	templateRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_operator_template_runs_total",
+			Help: "Total template runs count",
+		},
+		[]string{"template"},
+	)
+	templateRunsSucceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_operator_template_success_total",
+			Help: "Total successful template runs count",
+		},
+		[]string{"template"},
+	)
+	templateRunsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_operator_template_failed_total",
+			Help: "Total failed template runs count",
+		},
+		[]string{"template"},
+	)
+	restRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_operator_rest_runs_total",
+			Help: "Total rest runs count",
+		},
+		[]string{"rest"},
+	)
+	restRunsSucceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_operator_rest_success_total",
+			Help: "Total successful rest runs count",
+		},
+		[]string{"rest"},
+	)
+	restRunsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "template_operator_rest_failed_total",
+			Help: "Total failed rest runs count",
+		},
+		[]string{"rest"},
+	)
+	templateRenderDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "template_operator_template_render_duration_seconds",
+			Help:    "Time taken to render the resources of a template for a source",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"template"},
+	)
+	templateApplyDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "template_operator_apply_duration_seconds",
+			Help:    "Time taken to apply a generated object",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"group", "version", "kind"},
+	)
+	templateSources = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "template_operator_template_sources",
+			Help:    "Number of sources selected per template run",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{"template"},
+	)
+	templateGeneratedObjects = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "template_operator_template_generated_objects",
+			Help:    "Number of objects generated per source",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{"template"},
+	)
+	restRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "template_operator_rest_request_duration_seconds",
+			Help:    "Latency of REST requests, code is 0 if no response was received",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"host", "code"},
+	)
+	watcherInformers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "template_operator_watcher_informers",
+			Help: "Number of informers started to watch template sources",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(templateRuns, templateRunsSucceeded, templateRunsFailed, restRuns, restRunsSucceeded, restRunsFailed)
+	metrics.Registry.MustRegister(templateRenderDuration, templateApplyDuration, templateSources, templateGeneratedObjects, restRequestDuration, watcherInformers)
+}
+
+// ObserveTemplateRun counts a run of the template named name
+func ObserveTemplateRun(name string, failed bool) {
+	templateRuns.WithLabelValues(name).Inc()
+	if failed {
+		templateRunsFailed.WithLabelValues(name).Inc()
+	} else {
+		templateRunsSucceeded.WithLabelValues(name).Inc()
+	}
+}
+
+// ObserveRESTRun counts a run of the REST object named name
+func ObserveRESTRun(name string, failed bool) {
+	restRuns.WithLabelValues(name).Inc()
+	if failed {
+		restRunsFailed.WithLabelValues(name).Inc()
+	} else {
+		restRunsSucceeded.WithLabelValues(name).Inc()
+	}
+}
+
+func observeApply(obj *unstructured.Unstructured, start time.Time) {
+	gvk := obj.GroupVersionKind()
+	templateApplyDuration.WithLabelValues(gvk.Group, gvk.Version, gvk.Kind).Observe(time.Since(start).Seconds())
+}
+
+func observeRESTRequest(host string, statusCode int, duration time.Duration) {
+	restRequestDuration.WithLabelValues(host, strconv.Itoa(statusCode)).Observe(duration.Seconds())
+}
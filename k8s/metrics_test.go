@@ -0,0 +1,50 @@
+package k8s_test
+
+import (
+	"time"
+
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var _ = Describe("Metrics", func() {
+	counters := []string{
+		"template_operator_template_runs_total",
+		"template_operator_template_success_total",
+		"template_operator_template_failed_total",
+		"template_operator_rest_runs_total",
+		"template_operator_rest_success_total",
+		"template_operator_rest_failed_total",
+	}
+
+	It("Registers the run counters", func() {
+		k8s.ObserveTemplateRun("metrics", false)
+		k8s.ObserveTemplateRun("metrics", true)
+		k8s.ObserveRESTRun("metrics", false)
+		k8s.ObserveRESTRun("metrics", true)
+
+		families, err := metrics.Registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+		types := map[string]dto.MetricType{}
+		for _, family := range families {
+			types[family.GetName()] = family.GetType()
+		}
+		for _, name := range counters {
+			Expect(types).To(HaveKeyWithValue(name, dto.MetricType_COUNTER), name)
+		}
+	})
+
+	It("Follows the Prometheus naming conventions", func() {
+		k8s.ObserveTemplateRun("metrics", false)
+		k8s.ObserveRESTRun("metrics", false)
+		k8s.ObserveRESTRequest("metrics.example.com", 200, time.Millisecond)
+
+		problems, err := testutil.GatherAndLint(metrics.Registry, append(counters, "template_operator_rest_request_duration_seconds")...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(problems).To(BeEmpty())
+	})
+})
@@ -0,0 +1,240 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Annotations recording the template owning a generated object, and the templates
+// owning the fields of a source they patched
+const (
+	OwnerAnnotation         = "templating.flanksource.com/owner"
+	OwnerPriorityAnnotation = "templating.flanksource.com/owner-priority"
+	FieldOwnersAnnotation   = "templating.flanksource.com/field-owners"
+)
+
+// owner is a template claiming an object or a source field
+type owner struct {
+	Template string `json:"template"`
+	Priority int32  `json:"priority,omitempty"`
+}
+
+func templateOwner(template *templatev1.Template) owner {
+	return owner{Template: template.Name, Priority: template.Spec.Priority}
+}
+
+// yieldsTo returns whether a claim of o may be taken over by other, a template only
+// takes over claims of templates with a lower priority
+func (o owner) yieldsTo(other owner) bool {
+	return o.Template == "" || o.Template == other.Template || other.Priority > o.Priority
+}
+
+// getOwner returns the template owning obj, if any
+func getOwner(obj *unstructured.Unstructured) owner {
+	annotations := obj.GetAnnotations()
+	o := owner{Template: annotations[OwnerAnnotation]}
+	if priority, err := strconv.ParseInt(annotations[OwnerPriorityAnnotation], 10, 32); err == nil {
+		o.Priority = int32(priority)
+	}
+	return o
+}
+
+func setOwner(obj *unstructured.Unstructured, o owner) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[OwnerAnnotation] = o.Template
+	annotations[OwnerPriorityAnnotation] = strconv.Itoa(int(o.Priority))
+	obj.SetAnnotations(annotations)
+}
+
+// claims collects the conflicts found while a template claims the objects and fields
+// generated for a source, it is safe for concurrent use
+type claims struct {
+	owner     owner
+	mtx       sync.Mutex
+	conflicts []ResourceConflict
+}
+
+func newClaims(template *templatev1.Template) *claims {
+	return &claims{owner: templateOwner(template)}
+}
+
+func (c *claims) add(conflict ResourceConflict) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.conflicts = append(c.conflicts, conflict)
+}
+
+// claimObject claims obj generated for source for the owner of c, unless its live
+// object is owned by another template that is not overridden. The conflict is
+// returned and recorded in c in that case
+func (tm *TemplateManager) claimObject(ctx context.Context, c *claims, source unstructured.Unstructured, obj *unstructured.Unstructured) (*ResourceConflict, error) {
+	if c.owner.Template == "" {
+		return nil, nil
+	}
+	client, err := ResourceClient(tm.Client, obj.GetAPIVersion(), obj.GetKind())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get dynamic client for kind %s", obj.GetKind())
+	}
+	live, err := client.Namespace(obj.GetNamespace()).Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s", obj.GetKind(), obj.GetName())
+	}
+	return tm.claimLiveObject(ctx, c, source, obj, live)
+}
+
+// claimLiveObject claims obj for the owner of c given its live object, nil if it
+// does not exist yet
+func (tm *TemplateManager) claimLiveObject(ctx context.Context, c *claims, source unstructured.Unstructured, obj, live *unstructured.Unstructured) (*ResourceConflict, error) {
+	if live != nil {
+		current := getOwner(live)
+		if !current.yieldsTo(c.owner) {
+			exists, err := tm.templateExists(ctx, current.Template)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				conflict := &ResourceConflict{
+					Source:    SourceKey(source.GetKind(), source.GetNamespace(), source.GetName()),
+					Kind:      obj.GetKind(),
+					Namespace: obj.GetNamespace(),
+					Name:      obj.GetName(),
+					Owner:     current.Template,
+				}
+				c.add(*conflict)
+				tm.Events.Eventf(&source, v1.EventTypeWarning, "Conflict", "%s %s/%s is owned by template %s, not applying it", obj.GetKind(), obj.GetNamespace(), obj.GetName(), current.Template)
+				return conflict, nil
+			}
+		}
+		if current.Template != "" && current.Template != c.owner.Template {
+			tm.Events.Eventf(&source, v1.EventTypeNormal, "OwnerChanged", "Template %s took over %s %s/%s from template %s", c.owner.Template, obj.GetKind(), obj.GetNamespace(), obj.GetName(), current.Template)
+		}
+	}
+	setOwner(obj, c.owner)
+	return nil, nil
+}
+
+// claimFields claims the fields of source changed in patched for the owner of c.
+// Fields owned by another template that is not overridden are reverted to their
+// value in source, the conflict is recorded in c in that case
+func (tm *TemplateManager) claimFields(ctx context.Context, c *claims, source unstructured.Unstructured, patched *unstructured.Unstructured) error {
+	if c.owner.Template == "" {
+		return nil
+	}
+	owners := map[string]owner{}
+	if value := source.GetAnnotations()[FieldOwnersAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &owners); err != nil {
+			return errors.Wrap(err, "failed to unmarshal field owners")
+		}
+	}
+
+	exists := map[string]bool{}
+	conflicts := map[string][]string{}
+	for _, path := range changedFields(source.Object, patched.Object, nil) {
+		field := strings.Join(path, ".")
+		current, found := owners[field]
+		if found && !current.yieldsTo(c.owner) {
+			if _, checked := exists[current.Template]; !checked {
+				ok, err := tm.templateExists(ctx, current.Template)
+				if err != nil {
+					return err
+				}
+				exists[current.Template] = ok
+			}
+		}
+		if found && !current.yieldsTo(c.owner) && exists[current.Template] {
+			conflicts[current.Template] = append(conflicts[current.Template], field)
+			if value, found, _ := unstructured.NestedFieldNoCopy(source.Object, path...); found {
+				if err := unstructured.SetNestedField(patched.Object, runtime.DeepCopyJSONValue(value), path...); err != nil {
+					return errors.Wrapf(err, "failed to revert field %s", field)
+				}
+			} else {
+				unstructured.RemoveNestedField(patched.Object, path...)
+			}
+			continue
+		}
+		owners[field] = c.owner
+	}
+
+	for template, fields := range conflicts {
+		sort.Strings(fields)
+		c.add(ResourceConflict{
+			Source:    SourceKey(source.GetKind(), source.GetNamespace(), source.GetName()),
+			Kind:      source.GetKind(),
+			Namespace: source.GetNamespace(),
+			Name:      source.GetName(),
+			Fields:    fields,
+			Owner:     template,
+		})
+		tm.Events.Eventf(&source, v1.EventTypeWarning, "Conflict", "Fields %s are owned by template %s, not patching them", strings.Join(fields, ", "), template)
+	}
+
+	if len(owners) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(owners)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal field owners")
+	}
+	annotations := patched.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[FieldOwnersAnnotation] = string(data)
+	patched.SetAnnotations(annotations)
+	return nil
+}
+
+// changedFields returns the paths of the leaf fields of patched that differ from
+// original, lists are compared as a whole
+func changedFields(original, patched map[string]interface{}, path []string) [][]string {
+	var changed [][]string
+	for key, value := range patched {
+		fieldPath := append(append([]string{}, path...), key)
+		previous, found := original[key]
+		patchedMap, isMap := value.(map[string]interface{})
+		previousMap, wasMap := previous.(map[string]interface{})
+		if found && isMap && wasMap {
+			changed = append(changed, changedFields(previousMap, patchedMap, fieldPath)...)
+		} else if !found || !reflect.DeepEqual(previous, value) {
+			changed = append(changed, fieldPath)
+		}
+	}
+	return changed
+}
+
+// templateExists returns whether the template named name exists, claims of deleted
+// templates may be taken over by any template
+func (tm *TemplateManager) templateExists(ctx context.Context, name string) (bool, error) {
+	if tm.TemplateExists != nil {
+		return tm.TemplateExists(ctx, name)
+	}
+	client, err := ResourceClient(tm.Client, templatev1.GroupVersion.String(), "Template")
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get dynamic client for templates")
+	}
+	if _, err := client.Get(ctx, name, metav1.GetOptions{}); err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to get template %s", name)
+	}
+	return true, nil
+}
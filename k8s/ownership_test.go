@@ -0,0 +1,268 @@
+package k8s_test
+
+import (
+	"context"
+	"encoding/json"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("Ownership", func() {
+	ownerTemplate := func(name string, priority int32) *templatev1.Template {
+		return &templatev1.Template{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       templatev1.TemplateSpec{Priority: priority},
+		}
+	}
+
+	namespace := func(owners string) unstructured.Unstructured {
+		obj := unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata": map[string]interface{}{
+				"name":   "team-a",
+				"labels": map[string]interface{}{"team": "a"},
+			},
+		}}
+		if owners != "" {
+			obj.SetAnnotations(map[string]string{k8s.FieldOwnersAnnotation: owners})
+		}
+		return obj
+	}
+
+	fieldOwners := func(obj *unstructured.Unstructured) map[string]map[string]interface{} {
+		owners := map[string]map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(obj.GetAnnotations()[k8s.FieldOwnersAnnotation]), &owners)).To(Succeed())
+		return owners
+	}
+
+	Describe("changedFields", func() {
+		It("Returns the paths of changed and added leaf fields", func() {
+			original := map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]interface{}{"team": "a", "env": "dev"}},
+				"spec":     map[string]interface{}{"replicas": int64(1)},
+			}
+			patched := map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": map[string]interface{}{"team": "a", "env": "prod", "tier": "web"}},
+				"spec":     map[string]interface{}{"replicas": int64(1), "paused": true},
+			}
+			Expect(k8s.ChangedFields(original, patched)).To(Equal([]string{"metadata.labels.env", "metadata.labels.tier", "spec.paused"}))
+		})
+
+		It("Compares lists as a whole", func() {
+			original := map[string]interface{}{"spec": map[string]interface{}{"finalizers": []interface{}{"a"}}}
+			patched := map[string]interface{}{"spec": map[string]interface{}{"finalizers": []interface{}{"a", "b"}}}
+			Expect(k8s.ChangedFields(original, patched)).To(Equal([]string{"spec.finalizers"}))
+		})
+
+		It("Returns a map replacing a scalar as a single field", func() {
+			original := map[string]interface{}{"spec": "none"}
+			patched := map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}}
+			Expect(k8s.ChangedFields(original, patched)).To(Equal([]string{"spec"}))
+		})
+
+		It("Returns nothing if nothing changed", func() {
+			original := map[string]interface{}{"metadata": map[string]interface{}{"name": "a"}}
+			Expect(k8s.ChangedFields(original, original)).To(BeEmpty())
+		})
+	})
+
+	// templates other than deleted exist
+	templateExists := func(ctx context.Context, name string) (bool, error) {
+		return name != "deleted", nil
+	}
+
+	Describe("claimObject", func() {
+		tm := &k8s.TemplateManager{Events: record.NewFakeRecorder(100), TemplateExists: templateExists}
+		source := namespace("")
+		generated := func(owner string, priority string) *unstructured.Unstructured {
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"name": "settings", "namespace": "team-a"},
+			}}
+			if owner != "" {
+				obj.SetAnnotations(map[string]string{k8s.OwnerAnnotation: owner, k8s.OwnerPriorityAnnotation: priority})
+			}
+			return obj
+		}
+
+		It("Claims new and unowned objects", func() {
+			obj := generated("", "")
+			conflict, err := tm.ClaimObject(ownerTemplate("settings", 1), source, obj, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflict).To(BeNil())
+			Expect(obj.GetAnnotations()).To(HaveKeyWithValue(k8s.OwnerAnnotation, "settings"))
+			Expect(obj.GetAnnotations()).To(HaveKeyWithValue(k8s.OwnerPriorityAnnotation, "1"))
+
+			obj = generated("", "")
+			conflict, err = tm.ClaimObject(ownerTemplate("settings", 0), source, obj, generated("", ""))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflict).To(BeNil())
+		})
+
+		It("Keeps objects owned by a template with the same or a higher priority", func() {
+			for _, priority := range []string{"1", "2"} {
+				obj := generated("", "")
+				conflict, err := tm.ClaimObject(ownerTemplate("settings", 1), source, obj, generated("defaults", priority))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conflict).To(Equal(&k8s.ResourceConflict{
+					Source:    k8s.SourceKey("Namespace", "", "team-a"),
+					Kind:      "ConfigMap",
+					Namespace: "team-a",
+					Name:      "settings",
+					Owner:     "defaults",
+				}))
+				Expect(obj.GetAnnotations()).ToNot(HaveKey(k8s.OwnerAnnotation))
+			}
+		})
+
+		It("Takes over objects of templates with a lower priority", func() {
+			obj := generated("", "")
+			conflict, err := tm.ClaimObject(ownerTemplate("settings", 2), source, obj, generated("defaults", "1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflict).To(BeNil())
+			Expect(obj.GetAnnotations()).To(HaveKeyWithValue(k8s.OwnerAnnotation, "settings"))
+		})
+
+		It("Takes over objects of deleted templates", func() {
+			obj := generated("", "")
+			conflict, err := tm.ClaimObject(ownerTemplate("settings", 0), source, obj, generated("deleted", "5"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflict).To(BeNil())
+			Expect(obj.GetAnnotations()).To(HaveKeyWithValue(k8s.OwnerAnnotation, "settings"))
+		})
+
+		It("Keeps its own objects whatever their recorded priority", func() {
+			obj := generated("", "")
+			conflict, err := tm.ClaimObject(ownerTemplate("settings", 0), source, obj, generated("settings", "3"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflict).To(BeNil())
+			Expect(obj.GetAnnotations()).To(HaveKeyWithValue(k8s.OwnerPriorityAnnotation, "0"))
+		})
+	})
+
+	Describe("claimFields", func() {
+		tm := &k8s.TemplateManager{Events: record.NewFakeRecorder(100), TemplateExists: templateExists}
+
+		It("Claims the patched fields of a source", func() {
+			source := namespace("")
+			patched := source.DeepCopy()
+			Expect(unstructured.SetNestedField(patched.Object, "prod", "metadata", "labels", "env")).To(Succeed())
+
+			conflicts, err := tm.ClaimFields(ownerTemplate("labels", 0), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(BeEmpty())
+			Expect(fieldOwners(patched)).To(Equal(map[string]map[string]interface{}{
+				"metadata.labels.env": {"template": "labels"},
+			}))
+		})
+
+		It("Keeps the claims of other fields", func() {
+			source := namespace(`{"metadata.labels.team": {"template": "teams"}}`)
+			patched := source.DeepCopy()
+			Expect(unstructured.SetNestedField(patched.Object, "prod", "metadata", "labels", "env")).To(Succeed())
+
+			_, err := tm.ClaimFields(ownerTemplate("labels", 0), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			owners := fieldOwners(patched)
+			Expect(owners).To(HaveKey("metadata.labels.team"))
+			Expect(owners["metadata.labels.env"]).To(Equal(map[string]interface{}{"template": "labels"}))
+		})
+
+		It("Takes over fields of templates with a lower priority", func() {
+			source := namespace(`{"metadata.labels.team": {"template": "teams", "priority": 1}}`)
+			patched := source.DeepCopy()
+			Expect(unstructured.SetNestedField(patched.Object, "b", "metadata", "labels", "team")).To(Succeed())
+
+			conflicts, err := tm.ClaimFields(ownerTemplate("override", 2), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(BeEmpty())
+			Expect(patched.GetLabels()["team"]).To(Equal("b"))
+			Expect(fieldOwners(patched)["metadata.labels.team"]).To(Equal(map[string]interface{}{"template": "override", "priority": float64(2)}))
+		})
+
+		It("Does not record owners if no field changed", func() {
+			source := namespace("")
+			patched := source.DeepCopy()
+
+			_, err := tm.ClaimFields(ownerTemplate("labels", 0), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(patched.GetAnnotations()).ToNot(HaveKey(k8s.FieldOwnersAnnotation))
+		})
+
+		It("Reverts fields owned by a template with the same or a higher priority", func() {
+			source := namespace(`{"metadata.labels.team": {"template": "teams", "priority": 1}}`)
+			patched := source.DeepCopy()
+			Expect(unstructured.SetNestedField(patched.Object, "b", "metadata", "labels", "team")).To(Succeed())
+			Expect(unstructured.SetNestedField(patched.Object, "prod", "metadata", "labels", "env")).To(Succeed())
+
+			conflicts, err := tm.ClaimFields(ownerTemplate("labels", 1), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(Equal([]k8s.ResourceConflict{{
+				Source: k8s.SourceKey("Namespace", "", "team-a"),
+				Kind:   "Namespace",
+				Name:   "team-a",
+				Fields: []string{"metadata.labels.team"},
+				Owner:  "teams",
+			}}))
+			Expect(patched.GetLabels()).To(Equal(map[string]string{"team": "a", "env": "prod"}))
+			owners := fieldOwners(patched)
+			Expect(owners["metadata.labels.team"]).To(Equal(map[string]interface{}{"template": "teams", "priority": float64(1)}))
+			Expect(owners["metadata.labels.env"]).To(Equal(map[string]interface{}{"template": "labels", "priority": float64(1)}))
+		})
+
+		It("Removes fields added over a field owned by a higher priority template", func() {
+			source := namespace(`{"metadata.labels.env": {"template": "teams", "priority": 3}}`)
+			patched := source.DeepCopy()
+			Expect(unstructured.SetNestedField(patched.Object, "prod", "metadata", "labels", "env")).To(Succeed())
+
+			conflicts, err := tm.ClaimFields(ownerTemplate("labels", 1), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(HaveLen(1))
+			Expect(patched.GetLabels()).ToNot(HaveKey("env"))
+		})
+
+		It("Takes over fields of deleted templates", func() {
+			source := namespace(`{"metadata.labels.team": {"template": "deleted", "priority": 5}}`)
+			patched := source.DeepCopy()
+			Expect(unstructured.SetNestedField(patched.Object, "b", "metadata", "labels", "team")).To(Succeed())
+
+			conflicts, err := tm.ClaimFields(ownerTemplate("labels", 0), source, patched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conflicts).To(BeEmpty())
+			Expect(patched.GetLabels()["team"]).To(Equal("b"))
+			Expect(fieldOwners(patched)["metadata.labels.team"]).To(Equal(map[string]interface{}{"template": "labels"}))
+		})
+	})
+
+	Describe("Conflict condition", func() {
+		It("Counts the sources with conflicts", func() {
+			states := k8s.NewSourceStates()
+			conflict := k8s.ResourceConflict{Kind: "ConfigMap", Namespace: "team-a", Name: "settings", Owner: "defaults"}
+			states.Set("Namespace//team-a", k8s.SourceState{Reason: k8s.SourceReasonNotReady, Conflicts: []k8s.ResourceConflict{conflict, conflict}})
+			states.Set("Namespace//team-b", k8s.SourceState{Reason: k8s.SourceReasonReady})
+
+			summary := states.Summary("")
+			Expect(summary.Conflicts).To(Equal(1))
+			condition := k8s.ConflictCondition(3, summary)
+			Expect(condition.Type).To(Equal(templatev1.TemplateConditionConflict))
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal("OwnedByOtherTemplates"))
+			Expect(condition.ObservedGeneration).To(Equal(int64(3)))
+			Expect(condition.Message).To(ContainSubstring("1 sources"))
+		})
+
+		It("Is false without conflicts", func() {
+			condition := k8s.ConflictCondition(1, templatev1.TemplateSummary{Sources: 2, Ready: 2})
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal("NoConflicts"))
+		})
+	})
+})
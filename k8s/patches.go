@@ -2,6 +2,7 @@ package k8s
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"path/filepath"
 	osruntime "runtime"
@@ -11,6 +12,8 @@ import (
 	"github.com/flanksource/kommons/ktemplate"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	fyaml "gopkg.in/flanksource/yaml.v3"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -49,7 +52,14 @@ func NewPatchApplier(clientset *kubernetes.Clientset, schemaManager *SchemaManag
 	return p, nil
 }
 
-func (p *PatchApplier) Apply(resource *unstructured.Unstructured, patchStr string, patchType PatchType) (*unstructured.Unstructured, error) {
+func (p *PatchApplier) Apply(ctx context.Context, resource *unstructured.Unstructured, patchStr string, patchType PatchType) (patched *unstructured.Unstructured, err error) {
+	ctx, span := tracer.Start(ctx, "PatchApplier.Apply", trace.WithAttributes(
+		attribute.String("patchType", string(patchType)),
+		attribute.String("kind", resource.GetKind()),
+		attribute.String("name", resource.GetName()),
+	))
+	defer func() { endSpan(span, err) }()
+
 	// fmt.Printf("Template patch:\n%s\n====\n", patchStr)
 	t, err := template.New("patch").Funcs(p.FuncMap).Parse(patchStr)
 	if err != nil {
@@ -111,7 +121,7 @@ func (p *PatchApplier) Apply(resource *unstructured.Unstructured, patchStr strin
 			patchObject.SetNamespace(resource.GetNamespace())
 		}
 
-		if err := p.SchemaManager.DuckType(groupVersionKind, patchObject); err != nil {
+		if err := p.SchemaManager.DuckType(ctx, groupVersionKind, patchObject); err != nil {
 			p.Log.Error(err, "failed to duck type object")
 		}
 
@@ -1,6 +1,7 @@
 package k8s_test
 
 import (
+	"context"
 	"strings"
 
 	"github.com/flanksource/template-operator/k8s"
@@ -70,7 +71,7 @@ var _ = Describe("Patches", func() {
 			return "1.2.3.4.nip.io"
 		}
 
-		newResource, err := patchApplier.Apply(resource, patch, k8s.PatchTypeJSON)
+		newResource, err := patchApplier.Apply(context.TODO(), resource, patch, k8s.PatchTypeJSON)
 		Expect(err).To(BeNil())
 
 		specYaml, err := yaml.Marshal(newResource.Object)
@@ -139,7 +140,7 @@ spec:
 			return "1.2.3.4.nip.io"
 		}
 
-		newResource, err := patchApplier.Apply(resource, patch, k8s.PatchTypeJSON)
+		newResource, err := patchApplier.Apply(context.TODO(), resource, patch, k8s.PatchTypeJSON)
 		Expect(err).ToNot(HaveOccurred())
 
 		specYaml, err := yaml.Marshal(newResource.Object)
@@ -204,7 +205,7 @@ metadata:
 			return "1.2.3.4.nip.io"
 		}
 
-		newResource, err := patchApplier.Apply(resource, patch, k8s.PatchTypeYaml)
+		newResource, err := patchApplier.Apply(context.TODO(), resource, patch, k8s.PatchTypeYaml)
 		Expect(err).ToNot(HaveOccurred())
 
 		specYaml, err := yaml.Marshal(newResource.Object)
@@ -263,7 +264,7 @@ spec:
 			return strings.ReplaceAll(str, "\"", "\\\"")
 		}
 
-		newResource, err := patchApplier.Apply(resource, patch, k8s.PatchTypeYaml)
+		newResource, err := patchApplier.Apply(context.TODO(), resource, patch, k8s.PatchTypeYaml)
 		Expect(err).ToNot(HaveOccurred())
 
 		specYaml, err := yaml.Marshal(newResource.Object)
@@ -0,0 +1,109 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long a limiter is kept after its last use, limiters of
+// hosts no longer used are evicted so that the map does not grow unbounded
+const limiterIdleTimeout = 10 * time.Minute
+
+// HostRateLimiter limits the rate of requests sent to each host
+type HostRateLimiter struct {
+	mu          sync.Mutex
+	limiters    map[string]*hostLimiter
+	limit       rate.Limit
+	burst       int
+	idleTimeout time.Duration
+	lastEvicted time.Time
+}
+
+type hostLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+	// idle is how long the limiter may be unused before it is evicted, at least the
+	// time it takes to refill its burst so that evicting it does not reset the limit
+	idle time.Duration
+}
+
+// NewHostRateLimiter returns a limiter allowing qps requests per second to each host,
+// a qps of 0 or less disables the default limit
+func NewHostRateLimiter(qps float64, burst int) *HostRateLimiter {
+	limit := rate.Inf
+	if qps > 0 {
+		limit = rate.Limit(qps)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &HostRateLimiter{
+		limiters:    map[string]*hostLimiter{},
+		limit:       limit,
+		burst:       burst,
+		idleTimeout: limiterIdleTimeout,
+		lastEvicted: time.Now(),
+	}
+}
+
+// Wait blocks until a request to host is allowed, using override instead of the
+// default limit if set
+func (l *HostRateLimiter) Wait(ctx context.Context, host string, override *templatev1.RESTRateLimit) error {
+	if l == nil {
+		return nil
+	}
+	return l.limiter(host, override).Wait(ctx)
+}
+
+func (l *HostRateLimiter) limiter(host string, override *templatev1.RESTRateLimit) *rate.Limiter {
+	key, limit, burst := host, l.limit, l.burst
+	if override != nil && override.Requests > 0 {
+		period := time.Second
+		if override.Period != nil && override.Period.Duration > 0 {
+			period = override.Period.Duration
+		}
+		limit = rate.Every(period / time.Duration(override.Requests))
+		burst = 1
+		if override.Burst > 0 {
+			burst = int(override.Burst)
+		}
+		key = fmt.Sprintf("%s/%d/%v/%d", host, override.Requests, period, burst)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.evict(now)
+	limiter, found := l.limiters[key]
+	if !found {
+		idle := l.idleTimeout
+		if limit != rate.Inf {
+			if refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second)); refill > idle {
+				idle = refill
+			}
+		}
+		limiter = &hostLimiter{Limiter: rate.NewLimiter(limit, burst), idle: idle}
+		l.limiters[key] = limiter
+	}
+	limiter.lastUsed = now
+	return limiter.Limiter
+}
+
+// evict removes the limiters unused for longer than their idle timeout, at most once
+// per idle timeout
+func (l *HostRateLimiter) evict(now time.Time) {
+	if now.Sub(l.lastEvicted) < l.idleTimeout {
+		return
+	}
+	l.lastEvicted = now
+	for key, limiter := range l.limiters {
+		if now.Sub(limiter.lastUsed) > limiter.idle {
+			delete(l.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package k8s_test
+
+import (
+	"context"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HostRateLimiter", func() {
+	It("Evicts limiters of hosts no longer used", func() {
+		limiter := k8s.NewHostRateLimiter(0, 1)
+		limiter.SetIdleTimeout(10 * time.Millisecond)
+
+		Expect(limiter.Wait(context.Background(), "a.example.com", nil)).To(Succeed())
+		Expect(limiter.Wait(context.Background(), "b.example.com", nil)).To(Succeed())
+		Expect(limiter.Limiters()).To(Equal(2))
+
+		time.Sleep(20 * time.Millisecond)
+		Expect(limiter.Wait(context.Background(), "b.example.com", nil)).To(Succeed())
+		Expect(limiter.Limiters()).To(Equal(1))
+	})
+
+	It("Keeps limiters until their burst is refilled", func() {
+		limiter := k8s.NewHostRateLimiter(0, 1)
+		limiter.SetIdleTimeout(10 * time.Millisecond)
+
+		override := &templatev1.RESTRateLimit{Requests: 1, Burst: 1}
+		Expect(limiter.Wait(context.Background(), "a.example.com", override)).To(Succeed())
+
+		time.Sleep(20 * time.Millisecond)
+		Expect(limiter.Wait(context.Background(), "b.example.com", nil)).To(Succeed())
+		Expect(limiter.Limiters()).To(Equal(2))
+
+		// the limit of a.example.com still applies
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(limiter.Wait(ctx, "a.example.com", override)).ToNot(Succeed())
+	})
+})
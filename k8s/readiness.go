@@ -0,0 +1,168 @@
+package k8s
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/google/cel-go/cel"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// readinessPrograms caches the compiled CEL readiness expressions by expression
+var readinessPrograms sync.Map
+
+// readinessFor returns the readiness of a generated object, either set on the object
+// itself or by the ReadinessRule of its kind. It returns nil if neither is set
+func (tm *TemplateManager) readinessFor(obj *unstructured.Unstructured, readiness *templatev1.Readiness) *templatev1.Readiness {
+	if readiness != nil {
+		return readiness
+	}
+	for i, rule := range tm.ReadinessRules {
+		if rule.Spec.APIVersion == obj.GetAPIVersion() && rule.Spec.Kind == obj.GetKind() {
+			return &tm.ReadinessRules[i].Spec.Readiness
+		}
+	}
+	return nil
+}
+
+// evaluateReadiness returns whether the live object obj is ready according to
+// readiness. It fails if obj is still not ready once the readiness timeout passed
+// since it last changed
+func (tm *TemplateManager) evaluateReadiness(obj *unstructured.Unstructured, readiness *templatev1.Readiness) (bool, string, error) {
+	ready, msg, err := tm.checkReadiness(obj, readiness)
+	if err != nil || ready {
+		return ready, msg, err
+	}
+	if readiness.Timeout != nil && time.Since(lastChanged(obj)) > readiness.Timeout.Duration {
+		return false, msg, errors.Errorf("%s %s/%s is not ready after %v: %s", obj.GetKind(), obj.GetNamespace(), obj.GetName(), readiness.Timeout.Duration, msg)
+	}
+	return false, msg, nil
+}
+
+func (tm *TemplateManager) checkReadiness(obj *unstructured.Unstructured, readiness *templatev1.Readiness) (bool, string, error) {
+	if readiness.Condition != "" {
+		conditions, _, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		if err != nil {
+			return false, "", errors.Wrap(err, "failed to get status conditions")
+		}
+		found := false
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if !ok || condition["type"] != readiness.Condition {
+				continue
+			}
+			found = true
+			if condition["status"] != "True" {
+				return false, fmt.Sprintf("condition %s is %v: %v", readiness.Condition, condition["status"], condition["message"]), nil
+			}
+		}
+		if !found {
+			return false, fmt.Sprintf("condition %s not found", readiness.Condition), nil
+		}
+	}
+
+	if readiness.JSONPath != "" {
+		value, err := getJSONPath(obj.Object, readiness.JSONPath)
+		if err != nil {
+			return false, "", err
+		}
+		if !value.Exists() {
+			return false, fmt.Sprintf("%s not found", readiness.JSONPath), nil
+		}
+		if readiness.Value != "" && value.String() != readiness.Value {
+			return false, fmt.Sprintf("%s is %s, expected %s", readiness.JSONPath, value.String(), readiness.Value), nil
+		}
+		if readiness.Value == "" && !value.Bool() {
+			return false, fmt.Sprintf("%s is %s", readiness.JSONPath, value.String()), nil
+		}
+	}
+
+	if readiness.Expression != "" {
+		ready, msg, err := evaluateExpression(readiness.Expression, obj)
+		if err != nil || !ready {
+			return false, msg, err
+		}
+	}
+
+	return true, "", nil
+}
+
+// evaluateExpression evaluates the CEL readiness expression with obj as self. An
+// expression failing on fields missing from obj is not ready, as the controller of obj
+// may not have written them yet, other evaluation errors are returned
+func evaluateExpression(expression string, obj *unstructured.Unstructured) (bool, string, error) {
+	program, err := readinessProgram(expression)
+	if err != nil {
+		return false, "", err
+	}
+	out, _, err := program.Eval(map[string]interface{}{"self": obj.Object})
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "no such key") {
+			return false, fmt.Sprintf("%s: %v", expression, err), nil
+		}
+		return false, "", errors.Wrapf(err, "failed to evaluate readiness expression %s", expression)
+	}
+	ready, ok := out.Value().(bool)
+	if !ok {
+		return false, "", errors.Errorf("readiness expression %s must evaluate to a boolean, got %v", expression, out.Value())
+	}
+	if !ready {
+		return false, fmt.Sprintf("%s is false", expression), nil
+	}
+	return true, "", nil
+}
+
+func readinessProgram(expression string) (cel.Program, error) {
+	if program, found := readinessPrograms.Load(expression); found {
+		return program.(cel.Program), nil
+	}
+	env, err := cel.NewEnv(cel.Variable("self", cel.DynType))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cel environment")
+	}
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, errors.Wrapf(issues.Err(), "invalid readiness expression %s", expression)
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, errors.Errorf("readiness expression %s must evaluate to a boolean, not %s", expression, ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid readiness expression %s", expression)
+	}
+	readinessPrograms.Store(expression, program)
+	return program, nil
+}
+
+// lastChanged returns the time obj last changed: the latest of its creation, the last
+// update of its spec and the last transition of its status conditions
+func lastChanged(obj *unstructured.Unstructured) time.Time {
+	changed := obj.GetCreationTimestamp().Time
+	for _, field := range obj.GetManagedFields() {
+		if field.Subresource == "" && field.Time != nil && field.Time.After(changed) {
+			changed = field.Time.Time
+		}
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, ok := condition["lastTransitionTime"].(string)
+		if !ok {
+			continue
+		}
+		var transition metav1.Time
+		if err := transition.UnmarshalQueryParameter(value); err == nil && transition.After(changed) {
+			changed = transition.Time
+		}
+	}
+	return changed
+}
@@ -0,0 +1,160 @@
+package k8s_test
+
+import (
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("Readiness", func() {
+	database := func(phase string, conditionStatus string, transition time.Time) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "acid.zalan.do/v1",
+			"kind":       "postgresql",
+			"metadata":   map[string]interface{}{"name": "db", "namespace": "default"},
+			"status": map[string]interface{}{
+				"PostgresClusterStatus": phase,
+				"conditions": []interface{}{map[string]interface{}{
+					"type":               "Ready",
+					"status":             conditionStatus,
+					"message":            "waiting for pods",
+					"lastTransitionTime": transition.UTC().Format(time.RFC3339),
+				}},
+			},
+		}}
+		obj.SetCreationTimestamp(metav1.NewTime(time.Now().Add(-24 * time.Hour)))
+		return obj
+	}
+
+	rule := func(readiness templatev1.Readiness) []templatev1.ReadinessRule {
+		return []templatev1.ReadinessRule{{Spec: templatev1.ReadinessRuleSpec{
+			APIVersion: "acid.zalan.do/v1",
+			Kind:       "postgresql",
+			Readiness:  readiness,
+		}}}
+	}
+
+	It("Checks the status of a condition", func() {
+		readiness := &templatev1.Readiness{Condition: "Ready"}
+		ready, _, err := k8s.EvaluateReadiness(nil, database("Running", "True", time.Now()), readiness)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeTrue())
+
+		ready, msg, err := k8s.EvaluateReadiness(nil, database("Creating", "False", time.Now()), readiness)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(msg).To(Equal("condition Ready is False: waiting for pods"))
+	})
+
+	It("Compares the value of a json path", func() {
+		readiness := &templatev1.Readiness{JSONPath: "status.PostgresClusterStatus", Value: "Running"}
+		ready, _, err := k8s.EvaluateReadiness(nil, database("Running", "True", time.Now()), readiness)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeTrue())
+
+		ready, msg, err := k8s.EvaluateReadiness(nil, database("Creating", "True", time.Now()), readiness)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(msg).To(Equal("status.PostgresClusterStatus is Creating, expected Running"))
+	})
+
+	It("Evaluates CEL expressions with the object as self", func() {
+		readiness := &templatev1.Readiness{Expression: `self.status.PostgresClusterStatus == "Running" && self.status.conditions.exists(c, c.type == "Ready" && c.status == "True")`}
+		ready, _, err := k8s.EvaluateReadiness(nil, database("Running", "True", time.Now()), readiness)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeTrue())
+
+		ready, msg, err := k8s.EvaluateReadiness(nil, database("Running", "False", time.Now()), readiness)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(msg).To(ContainSubstring("is false"))
+	})
+
+	It("Is not ready while fields of the expression are missing", func() {
+		obj := database("Running", "True", time.Now())
+		unstructured.RemoveNestedField(obj.Object, "status")
+
+		ready, msg, err := k8s.EvaluateReadiness(nil, obj, &templatev1.Readiness{Expression: `self.status.PostgresClusterStatus == "Running"`})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeFalse())
+		Expect(msg).To(ContainSubstring("no such key: status"))
+
+		ready, _, err = k8s.EvaluateReadiness(nil, obj, &templatev1.Readiness{Expression: `!has(self.status)`})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeTrue())
+	})
+
+	It("Returns the errors of expressions failing on present fields", func() {
+		obj := database("Running", "True", time.Now())
+		_, _, err := k8s.EvaluateReadiness(nil, obj, &templatev1.Readiness{Expression: `self.status.PostgresClusterStatus + 1 > 0`})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("failed to evaluate readiness expression"))
+
+		_, _, err = k8s.EvaluateReadiness(nil, obj, &templatev1.Readiness{Expression: `self.status.conditions[5].status == "True"`})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Rejects invalid and non boolean expressions", func() {
+		_, _, err := k8s.EvaluateReadiness(nil, database("Running", "True", time.Now()), &templatev1.Readiness{Expression: `self.status ==`})
+		Expect(err).To(HaveOccurred())
+
+		_, _, err = k8s.EvaluateReadiness(nil, database("Running", "True", time.Now()), &templatev1.Readiness{Expression: `"ready"`})
+		Expect(err).To(HaveOccurred())
+
+		_, _, err = k8s.EvaluateReadiness(nil, database("Running", "True", time.Now()), &templatev1.Readiness{Expression: `self.status.PostgresClusterStatus`})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Uses the rule of the kind unless the resource sets its readiness", func() {
+		rules := rule(templatev1.Readiness{JSONPath: "status.PostgresClusterStatus", Value: "Running"})
+		ready, _, err := k8s.EvaluateReadiness(rules, database("Creating", "True", time.Now()), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeFalse())
+
+		ready, _, err = k8s.EvaluateReadiness(rules, database("Creating", "True", time.Now()), &templatev1.Readiness{Condition: "Ready"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ready).To(BeTrue())
+	})
+
+	Describe("Timeout", func() {
+		readiness := &templatev1.Readiness{Condition: "Ready", Timeout: &metav1.Duration{Duration: time.Hour}}
+
+		It("Fails once the object did not change within the timeout", func() {
+			_, _, err := k8s.EvaluateReadiness(nil, database("Creating", "False", time.Now().Add(-2*time.Hour)), readiness)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is not ready after 1h0m0s"))
+		})
+
+		It("Is measured from the last transition of a condition", func() {
+			ready, _, err := k8s.EvaluateReadiness(nil, database("Creating", "False", time.Now().Add(-time.Minute)), readiness)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ready).To(BeFalse())
+		})
+
+		It("Is measured from the last update of the spec", func() {
+			obj := database("Creating", "False", time.Now().Add(-2*time.Hour))
+			updated := metav1.NewTime(time.Now().Add(-time.Minute))
+			status := metav1.NewTime(time.Now().Add(-30 * time.Second))
+			obj.SetManagedFields([]metav1.ManagedFieldsEntry{
+				{Manager: "template-operator", Operation: metav1.ManagedFieldsOperationUpdate, Time: &updated},
+				{Manager: "postgres-operator", Operation: metav1.ManagedFieldsOperationUpdate, Time: &status, Subresource: "status"},
+			})
+			ready, _, err := k8s.EvaluateReadiness(nil, obj, readiness)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ready).To(BeFalse())
+
+			updated = metav1.NewTime(time.Now().Add(-90 * time.Minute))
+			obj.SetManagedFields([]metav1.ManagedFieldsEntry{
+				{Manager: "template-operator", Operation: metav1.ManagedFieldsOperationUpdate, Time: &updated},
+				{Manager: "postgres-operator", Operation: metav1.ManagedFieldsOperationUpdate, Time: &status, Subresource: "status"},
+			})
+			_, _, err = k8s.EvaluateReadiness(nil, obj, readiness)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,60 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	redactedValue = "[REDACTED]"
+	// maxLoggedBodySize is the size after which bodies are truncated in logs and errors
+	maxLoggedBodySize = 1024
+	// minRedactedLength is the length from which secrets are redacted wherever they
+	// appear, shorter ones are only redacted from values equal to them, as replacing
+	// every occurrence of a few characters would mangle the redacted text
+	minRedactedLength = 6
+)
+
+// redactor masks known secret values, such as credentials resolved from secrets,
+// before they are logged, recorded in events or persisted in status
+type redactor struct {
+	secrets []string
+}
+
+func (r *redactor) add(values ...string) {
+	if r == nil {
+		return
+	}
+	for _, value := range values {
+		if value != "" {
+			r.secrets = append(r.secrets, value)
+		}
+	}
+	// replace longer values first, in case a secret contains another one
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, secret := range r.secrets {
+		if s == secret {
+			return redactedValue
+		}
+		if len(secret) >= minRedactedLength {
+			s = strings.ReplaceAll(s, secret, redactedValue)
+		}
+	}
+	return s
+}
+
+// truncate redacts s and truncates it to maxLoggedBodySize
+func (r *redactor) truncate(s string) string {
+	s = r.redact(s)
+	if len(s) <= maxLoggedBodySize {
+		return s
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", s[:maxLoggedBodySize], len(s)-maxLoggedBodySize)
+}
@@ -0,0 +1,62 @@
+package k8s_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"text/template"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Redactor", func() {
+	It("Redacts every occurrence of secrets, longest first", func() {
+		Expect(k8s.Redact("user=admin password=hunter22 token=hunter22-extra", "hunter22", "hunter22-extra")).
+			To(Equal("user=admin password=[REDACTED] token=[REDACTED]"))
+	})
+
+	It("Only redacts short secrets from values equal to them", func() {
+		Expect(k8s.Redact("status=active", "a")).To(Equal("status=active"))
+		Expect(k8s.Redact("a", "a")).To(Equal("[REDACTED]"))
+	})
+
+	It("Ignores empty secrets", func() {
+		Expect(k8s.Redact("value", "")).To(Equal("value"))
+	})
+
+	It("Redacts values read with kget", func() {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			w.Write(body) // nolint: errcheck
+		}))
+		defer api.Close()
+
+		rest := &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "kget", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL: api.URL,
+				Update: templatev1.RESTAction{
+					Method: http.MethodPost,
+					URL:    api.URL + `?token={{ kget "secret/default/creds" "data.token" }}`,
+					Body:   `{{ kget "secret/default/creds" "data.token" }}`,
+					Status: map[string]string{"echo": "{{ .response.raw }}"},
+				},
+			},
+		}
+		restManager := &k8s.RESTManager{
+			Log: testLog,
+			FuncMap: template.FuncMap{
+				"kget": func(path, jsonpath string) string { return "s3cr3t-token" },
+			},
+		}
+		Expect(restManager.Update(context.Background(), rest)).To(Succeed())
+
+		Expect(rest.Status.LastRequest.URL).To(Equal(api.URL + "?token=[REDACTED]"))
+		Expect(rest.Status.Outputs["echo"]).To(Equal("[REDACTED]"))
+	})
+})
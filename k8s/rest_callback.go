@@ -0,0 +1,145 @@
+package k8s
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/kommons"
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+)
+
+// ErrCallbackUnauthorized is returned when a callback fails token or signature verification
+var ErrCallbackUnauthorized = errors.New("callback verification failed")
+
+// callbackMaxAge is how far the signature timestamp of a callback may be from the
+// current time, older callbacks are rejected as possible replays
+const callbackMaxAge = 5 * time.Minute
+
+// VerifyCallback checks the token and HMAC signature of a callback received for rest
+func (r *RESTManager) VerifyCallback(rest templatev1.RESTObject, header http.Header, body []byte) error {
+	callback := rest.GetSpec().Callback
+	if callback.Token == nil && callback.HMAC == nil {
+		return errors.Wrap(ErrCallbackUnauthorized, "callback.token or callback.hmac must be set")
+	}
+
+	var token, key string
+	var err error
+	if callback.Token != nil {
+		if token, err = r.callbackSecret(rest, "token", *callback.Token); err != nil {
+			return err
+		}
+		if token == "" {
+			return errors.Wrap(ErrCallbackUnauthorized, "callback token is empty")
+		}
+	}
+	if callback.HMAC != nil {
+		if key, err = r.callbackSecret(rest, "hmac", *callback.HMAC); err != nil {
+			return err
+		}
+		if key == "" {
+			return errors.Wrap(ErrCallbackUnauthorized, "callback hmac key is empty")
+		}
+	}
+	return verifyCallback(token, key, header, body, time.Now())
+}
+
+// verifyCallback checks the token and HMAC signature of a callback received at now,
+// empty token or key skip the respective check
+func verifyCallback(token, key string, header http.Header, body []byte, now time.Time) error {
+	if token != "" {
+		received := header.Get("X-Callback-Token")
+		if received == "" {
+			received = strings.TrimPrefix(header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+			return errors.Wrap(ErrCallbackUnauthorized, "invalid token")
+		}
+	}
+
+	if key != "" {
+		timestamp := header.Get("X-Signature-Timestamp")
+		signed, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.Wrap(ErrCallbackUnauthorized, "missing or invalid signature timestamp")
+		}
+		if age := now.Sub(time.Unix(signed, 0)); age > callbackMaxAge || age < -callbackMaxAge {
+			return errors.Wrapf(ErrCallbackUnauthorized, "signature timestamp is %v away from the current time", age.Round(time.Second))
+		}
+		if !hmac.Equal([]byte(header.Get("X-Signature-256")), []byte(CallbackSignature(key, timestamp, body))) {
+			return errors.Wrap(ErrCallbackUnauthorized, "invalid signature")
+		}
+	}
+
+	return nil
+}
+
+// CallbackSignature returns the X-Signature-256 header of a callback sent with the
+// X-Signature-Timestamp header timestamp, the hmac of "<timestamp>.<body>"
+func CallbackSignature(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Callback templates the callback status fields of rest into its outputs and returns
+// whether the success expression holds
+func (r *RESTManager) Callback(rest templatev1.RESTObject, header http.Header, body []byte) (bool, error) {
+	callback := rest.GetSpec().Callback
+
+	data, err := restTemplateData(rest)
+	if err != nil {
+		return false, err
+	}
+	received := &restResponse{Header: header, Body: body}
+	data["callback"] = received.templateData()
+
+	red := &redactor{}
+	outputs := map[string]string{}
+	for k, v := range callback.Status {
+		value, err := r.templateField(red, data, v)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to template callback status field %s", k)
+		}
+		outputs[k] = value
+	}
+	for k, v := range outputs {
+		outputs[k] = red.redact(v)
+	}
+
+	mergeOutputs(rest.GetStatus(), outputs)
+
+	if callback.Success == "" {
+		return true, nil
+	}
+	success, err := r.templateField(red, data, callback.Success)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to template callback success")
+	}
+	return strings.TrimSpace(success) == "true", nil
+}
+
+func (r *RESTManager) callbackSecret(rest templatev1.RESTObject, name string, source kommons.EnvVarSource) (string, error) {
+	namespace, err := authNamespace(rest)
+	if err != nil {
+		return "", err
+	}
+	if namespace == "" {
+		return "", errors.Errorf("auth.namespace is required to read the callback %s", name)
+	}
+	_, value, err := r.envValue(kommons.EnvVar{Name: name, ValueFrom: &source}, namespace)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get callback %s value", name)
+	}
+	if value == "" {
+		return "", errors.Errorf("callback %s is empty", name)
+	}
+	return value, nil
+}
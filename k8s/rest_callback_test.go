@@ -0,0 +1,72 @@
+package k8s_test
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("RESTCallback", func() {
+	body := []byte(`{"state": "available"}`)
+	now := time.Unix(1700000000, 0)
+
+	signed := func(key string, at time.Time, body []byte) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		header := http.Header{}
+		header.Set("X-Signature-Timestamp", timestamp)
+		header.Set("X-Signature-256", k8s.CallbackSignature(key, timestamp, body))
+		return header
+	}
+
+	expectUnauthorized := func(err error) {
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, k8s.ErrCallbackUnauthorized)).To(BeTrue())
+	}
+
+	It("Accepts tokens in the X-Callback-Token or Authorization header", func() {
+		Expect(k8s.VerifyCallback("secret", "", http.Header{"X-Callback-Token": {"secret"}}, body, now)).To(Succeed())
+		Expect(k8s.VerifyCallback("secret", "", http.Header{"Authorization": {"Bearer secret"}}, body, now)).To(Succeed())
+	})
+
+	It("Rejects invalid or missing tokens", func() {
+		expectUnauthorized(k8s.VerifyCallback("secret", "", http.Header{"X-Callback-Token": {"other"}}, body, now))
+		expectUnauthorized(k8s.VerifyCallback("secret", "", http.Header{}, body, now))
+	})
+
+	It("Accepts callbacks signed with the key", func() {
+		Expect(k8s.VerifyCallback("", "key", signed("key", now.Add(-time.Minute), body), body, now)).To(Succeed())
+	})
+
+	It("Rejects callbacks signed with another key or for another body", func() {
+		expectUnauthorized(k8s.VerifyCallback("", "key", signed("other", now, body), body, now))
+		expectUnauthorized(k8s.VerifyCallback("", "key", signed("key", now, []byte(`{}`)), body, now))
+	})
+
+	It("Rejects callbacks without or with a changed timestamp", func() {
+		header := signed("key", now, body)
+		header.Del("X-Signature-Timestamp")
+		expectUnauthorized(k8s.VerifyCallback("", "key", header, body, now))
+
+		header = signed("key", now, body)
+		header.Set("X-Signature-Timestamp", strconv.FormatInt(now.Add(time.Second).Unix(), 10))
+		expectUnauthorized(k8s.VerifyCallback("", "key", header, body, now))
+	})
+
+	It("Rejects replayed callbacks", func() {
+		expectUnauthorized(k8s.VerifyCallback("", "key", signed("key", now.Add(-10*time.Minute), body), body, now))
+		expectUnauthorized(k8s.VerifyCallback("", "key", signed("key", now.Add(10*time.Minute), body), body, now))
+	})
+
+	It("Requires both the token and the signature if both are set", func() {
+		header := signed("key", now, body)
+		expectUnauthorized(k8s.VerifyCallback("secret", "key", header, body, now))
+
+		header.Set("X-Callback-Token", "secret")
+		Expect(k8s.VerifyCallback("secret", "key", header, body, now)).To(Succeed())
+	})
+})
@@ -0,0 +1,102 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTDelete", func() {
+	var api *httptest.Server
+	var status int
+	var removed int
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		removed = 0
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			removed++
+			w.WriteHeader(status)
+		}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	rest := func() *templatev1.REST {
+		return &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "delete"},
+			Spec: templatev1.RESTSpec{
+				URL:    api.URL,
+				Remove: templatev1.RESTAction{Method: http.MethodDelete},
+			},
+		}
+	}
+
+	It("Sends the remove request", func() {
+		r := rest()
+		Expect((&k8s.RESTManager{Log: testLog}).Delete(context.Background(), r)).To(Succeed())
+		Expect(removed).To(Equal(1))
+		Expect(r.Status.LastRequest.Action).To(Equal("remove"))
+	})
+
+	It("Treats a remote resource that is not found as removed", func() {
+		status = http.StatusNotFound
+		r := rest()
+		Expect((&k8s.RESTManager{Log: testLog}).Delete(context.Background(), r)).To(Succeed())
+		Expect(removed).To(Equal(1))
+		Expect(r.Status.LastRequest.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("Fails on other error statuses", func() {
+		status = http.StatusInternalServerError
+		Expect((&k8s.RESTManager{Log: testLog}).Delete(context.Background(), rest())).ToNot(Succeed())
+	})
+
+	It("Orphans objects with deletionPolicy Orphan or the orphan annotation", func() {
+		r := rest()
+		Expect(k8s.IsOrphaned(r)).To(BeFalse())
+		r.Spec.DeletionPolicy = templatev1.RESTDeletionPolicyDelete
+		Expect(k8s.IsOrphaned(r)).To(BeFalse())
+		r.Spec.DeletionPolicy = templatev1.RESTDeletionPolicyOrphan
+		Expect(k8s.IsOrphaned(r)).To(BeTrue())
+
+		r = rest()
+		r.Annotations = map[string]string{templatev1.RESTOrphanAnnotation: "false"}
+		Expect(k8s.IsOrphaned(r)).To(BeFalse())
+		r.Annotations[templatev1.RESTOrphanAnnotation] = "true"
+		Expect(k8s.IsOrphaned(r)).To(BeTrue())
+	})
+
+	It("Measures the remove timeout from the deletion timestamp", func() {
+		now := time.Now()
+		r := rest()
+		timeout, timedOut := k8s.RemoveTimedOut(r, now)
+		Expect(timeout).To(Equal(k8s.DefaultRemoveTimeout))
+		Expect(timedOut).To(BeFalse())
+
+		r.DeletionTimestamp = &metav1.Time{Time: now.Add(-k8s.DefaultRemoveTimeout + time.Minute)}
+		_, timedOut = k8s.RemoveTimedOut(r, now)
+		Expect(timedOut).To(BeFalse())
+		r.DeletionTimestamp = &metav1.Time{Time: now.Add(-k8s.DefaultRemoveTimeout - time.Minute)}
+		_, timedOut = k8s.RemoveTimedOut(r, now)
+		Expect(timedOut).To(BeTrue())
+
+		r.Spec.RemoveTimeout = &metav1.Duration{Duration: 5 * time.Minute}
+		r.DeletionTimestamp = &metav1.Time{Time: now.Add(-4 * time.Minute)}
+		timeout, timedOut = k8s.RemoveTimedOut(r, now)
+		Expect(timeout).To(Equal(5 * time.Minute))
+		Expect(timedOut).To(BeFalse())
+		r.DeletionTimestamp = &metav1.Time{Time: now.Add(-6 * time.Minute)}
+		_, timedOut = k8s.RemoveTimedOut(r, now)
+		Expect(timedOut).To(BeTrue())
+	})
+})
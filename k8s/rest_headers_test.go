@@ -0,0 +1,148 @@
+package k8s_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/flanksource/kommons"
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("RESTHeaders", func() {
+	const token = "s3cr3t-token-value"
+
+	var api *httptest.Server
+	var status int
+	var received http.Header
+	var mtx sync.Mutex
+	var logs []string
+	var events *record.FakeRecorder
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		logs = nil
+		events = record.NewFakeRecorder(10)
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received = req.Header.Clone()
+			// the remote API echoes the headers it received
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{ // nolint: errcheck
+				"trace":  req.Header.Get("X-Trace"),
+				"region": req.Header.Get("X-Region"),
+				"token":  req.Header.Get("X-Token"),
+			})
+		}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	restManager := func() *k8s.RESTManager {
+		return &k8s.RESTManager{
+			Log: funcr.New(func(prefix, args string) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				logs = append(logs, args)
+			}, funcr.Options{Verbosity: 3}),
+			Events: events,
+			EnvValue: func(input kommons.EnvVar, namespace string) (string, string, error) {
+				return input.Name, token, nil
+			},
+		}
+	}
+
+	rest := func() *templatev1.NamespacedREST {
+		return &templatev1.NamespacedREST{
+			ObjectMeta: metav1.ObjectMeta{Name: "headers", Namespace: "default", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL:     api.URL,
+				Headers: map[string]string{"X-Trace": "{{ .metadata.name }}-trace"},
+				HeadersFrom: []kommons.EnvVar{
+					{Name: "X-Region", Value: "{{ .metadata.namespace }}-region"},
+					{Name: "X-Token", ValueFrom: &kommons.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: "token"},
+						Key:                  "token",
+					}}},
+				},
+				Update: templatev1.RESTAction{
+					Method: http.MethodPost,
+					Body:   "{}",
+					Status: map[string]string{
+						"trace":  "{{ .response.trace }}",
+						"region": "{{ .response.region }}",
+						"token":  "{{ .response.token }}",
+					},
+				},
+			},
+		}
+	}
+
+	leaked := func(r *templatev1.NamespacedREST) []string {
+		var found []string
+		mtx.Lock()
+		defer mtx.Unlock()
+		Expect(logs).ToNot(BeEmpty())
+		Expect(events.Events).ToNot(BeEmpty())
+		for _, line := range logs {
+			if strings.Contains(line, token) {
+				found = append(found, "log: "+line)
+			}
+		}
+		close(events.Events)
+		for event := range events.Events {
+			if strings.Contains(event, token) {
+				found = append(found, "event: "+event)
+			}
+		}
+		status, _ := json.Marshal(r.Status)
+		if strings.Contains(string(status), token) {
+			found = append(found, "status: "+string(status))
+		}
+		return found
+	}
+
+	It("Renders templated headers and headersFrom", func() {
+		r := rest()
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+
+		Expect(received.Get("X-Trace")).To(Equal("headers-trace"))
+		Expect(received.Get("X-Region")).To(Equal("default-region"))
+		Expect(received.Get("X-Token")).To(Equal(token))
+	})
+
+	It("Redacts header values read from secrets in logs, events and status", func() {
+		r := rest()
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+
+		Expect(r.Status.Outputs).To(Equal(map[string]string{
+			"trace":  "headers-trace",
+			"region": "default-region",
+			"token":  "[REDACTED]",
+		}))
+		Expect(leaked(r)).To(BeEmpty())
+	})
+
+	It("Redacts header values echoed in errors", func() {
+		status = http.StatusUnauthorized
+		r := rest()
+		err := restManager().Update(context.Background(), r)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("[REDACTED]"))
+		Expect(err.Error()).ToNot(ContainSubstring(token))
+		Expect(r.Status.LastRequest.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(leaked(r)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,75 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTHistory", func() {
+	var api *httptest.Server
+
+	BeforeEach(func() {
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	send := func(restManager *k8s.RESTManager, rest *templatev1.REST, generations int) {
+		for i := 1; i <= generations; i++ {
+			rest.Generation = int64(i)
+			Expect(restManager.Update(context.Background(), rest)).To(Succeed())
+		}
+	}
+
+	rest := func() *templatev1.REST {
+		return &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "history"},
+			Spec: templatev1.RESTSpec{
+				URL:    api.URL,
+				Update: templatev1.RESTAction{Method: http.MethodPost, Body: "{{ .metadata.generation }}"},
+			},
+		}
+	}
+
+	It("Keeps the last requests up to the history limit, oldest first", func() {
+		r := rest()
+		send(&k8s.RESTManager{Log: testLog, HistoryLimit: 3}, r, 5)
+
+		Expect(r.Status.History).To(HaveLen(3))
+		Expect(r.Status.History[2]).To(Equal(*r.Status.LastRequest))
+		for i := 1; i < len(r.Status.History); i++ {
+			Expect(r.Status.History[i].Time.Before(&r.Status.History[i-1].Time)).To(BeFalse())
+		}
+		for _, request := range r.Status.History {
+			Expect(request.Action).To(Equal("update"))
+			Expect(request.StatusCode).To(Equal(http.StatusOK))
+		}
+	})
+
+	It("Trims an existing history to a lower limit", func() {
+		r := rest()
+		send(&k8s.RESTManager{Log: testLog, HistoryLimit: 5}, r, 5)
+		Expect(r.Status.History).To(HaveLen(5))
+
+		r.Generation = 6
+		Expect((&k8s.RESTManager{Log: testLog, HistoryLimit: 2}).Update(context.Background(), r)).To(Succeed())
+		Expect(r.Status.History).To(HaveLen(2))
+		Expect(r.Status.History[1]).To(Equal(*r.Status.LastRequest))
+	})
+
+	It("Keeps no history with a limit of 0", func() {
+		r := rest()
+		send(&k8s.RESTManager{Log: testLog}, r, 2)
+		Expect(r.Status.History).To(BeEmpty())
+		Expect(r.Status.LastRequest).ToNot(BeNil())
+	})
+})
@@ -8,17 +8,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/flanksource/kommons"
 	"github.com/flanksource/kommons/ktemplate"
 	templatev1 "github.com/flanksource/template-operator/api/v1"
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 type RESTManager struct {
@@ -26,8 +33,26 @@ type RESTManager struct {
 	kubernetes.Interface
 	Log     logr.Logger
 	FuncMap template.FuncMap
+	// RateLimiter limits the rate of requests sent to each host, unlimited if nil
+	RateLimiter *HostRateLimiter
+	// Events records an event on the REST object for each request sent, if set
+	Events record.EventRecorder
+	// HistoryLimit is the number of requests kept in status.history
+	HistoryLimit int
+	// Namespace restricts kget in templates to secrets and config maps of this
+	// namespace if set, used for NamespacedREST objects
+	Namespace string
+	// EnvValue returns the value of a secret or config map reference, read with
+	// Client by default
+	EnvValue func(input kommons.EnvVar, namespace string) (string, string, error)
 }
 
+const (
+	restActionUpdate = "update"
+	restActionRemove = "remove"
+	restActionPoll   = "poll"
+)
+
 func NewRESTManager(c *kommons.Client, log logr.Logger) (*RESTManager, error) {
 	clientset, _ := c.GetClientset()
 
@@ -42,119 +67,402 @@ func NewRESTManager(c *kommons.Client, log logr.Logger) (*RESTManager, error) {
 	return tm, nil
 }
 
-func (r *RESTManager) Update(ctx context.Context, rest *templatev1.REST) (map[string]string, error) {
+// Update sends the update request if the REST generation changed since the last
+// successful request, or with resyncOnChange if the rendered request changed, and
+// records the request and templated outputs on rest.Status
+func (r *RESTManager) Update(ctx context.Context, rest templatev1.RESTObject) error {
+	if sameGeneration(rest) && !rest.GetSpec().ResyncOnChange {
+		return nil
+	}
+
+	status := rest.GetStatus()
+
+	data, err := restTemplateData(rest)
+	if err != nil {
+		return err
+	}
+	request, err := r.renderRequest(rest, data, rest.GetSpec().Update)
+	if err != nil {
+		return err
+	}
 	if sameGeneration(rest) {
-		return nil, nil
+		hash := request.hash()
+		if status.RequestHash == "" {
+			// sent before the hash was recorded, assume it did not change
+			status.RequestHash = hash
+		}
+		if status.RequestHash == hash {
+			return nil
+		}
+		r.Log.Info("Rendered request changed, re-sending update")
 	}
 
-	url := rest.Spec.Update.URL
-	method := rest.Spec.Update.Method
-	body := rest.Spec.Update.Body
+	resp, err := r.doRequest(ctx, request)
+	r.recordRequest(rest, restActionUpdate, resp, err)
+	if err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
 
-	resp, err := r.doRequest(ctx, rest, url, method, body)
+	outputs, err := r.templateOutputs(data, resp, rest.GetSpec().Update)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to send request")
+		return err
+	}
+
+	mergeOutputs(status, outputs)
+	status.ObservedGeneration = rest.GetGeneration()
+	if status.RequestHash, err = r.requestHash(rest); err != nil {
+		return err
+	}
+	if rest.GetSpec().Update.Poll != nil {
+		status.Poll = &templatev1.RESTPollStatus{Phase: templatev1.RESTPollPolling, StartTime: metav1.Now()}
+	} else {
+		status.Poll = nil
 	}
 
-	respBody := map[string]interface{}{}
-	if err := json.Unmarshal(resp, &respBody); err != nil {
-		r.Log.Info("failed to unmarshal response body", "error", err)
+	return nil
+}
+
+// Delete sends the remove request. Nothing is sent if remove.method is empty, and a
+// 404 response is treated as the remote resource being already removed
+func (r *RESTManager) Delete(ctx context.Context, rest templatev1.RESTObject) error {
+	remove := rest.GetSpec().Remove
+	if remove.Method == "" && remove.GraphQL == nil {
+		r.Log.V(2).Info("No remove method defined, skipping remove request")
+		return nil
 	}
 
-	statusUpdates := map[string]string{}
+	data, err := restTemplateData(rest)
+	if err != nil {
+		return err
+	}
+	request, err := r.renderRequest(rest, data, remove)
+	if err != nil {
+		return err
+	}
 
-	if rest.Spec.Update.Status != nil {
-		for k, v := range rest.Spec.Update.Status {
-			value, err := r.templateStatus(rest, respBody, v)
-			if err != nil {
-				return nil, errors.Wrapf(err, "failed to template status field %s", k)
-			}
-			statusUpdates[k] = value
+	resp, err := r.doRequest(ctx, request)
+	r.recordRequest(rest, restActionRemove, resp, err)
+	if err != nil {
+		if resp != nil && resp.Request.StatusCode == http.StatusNotFound {
+			r.Log.V(2).Info("Remote resource not found, assuming it was already removed")
+			return nil
 		}
+		return errors.Wrap(err, "failed to send request")
 	}
 
-	statusUpdates["observedGeneration"] = strconv.FormatInt(rest.ObjectMeta.Generation, 10)
+	r.Log.V(2).Info("Sent remove request")
+	return nil
+}
+
+// DefaultRemoveTimeout is how long a failing remove request is retried if
+// spec.removeTimeout is not set
+const DefaultRemoveTimeout = time.Hour
 
-	return statusUpdates, nil
+// IsOrphaned returns true if the remote resource of rest is left in place when rest
+// is deleted, through spec.deletionPolicy or the orphan annotation
+func IsOrphaned(rest templatev1.RESTObject) bool {
+	return rest.GetSpec().DeletionPolicy == templatev1.RESTDeletionPolicyOrphan || rest.GetAnnotations()[templatev1.RESTOrphanAnnotation] == "true"
 }
 
-func (r *RESTManager) Delete(ctx context.Context, rest *templatev1.REST) error {
-	url := rest.Spec.Remove.URL
-	method := rest.Spec.Remove.Method
-	body := rest.Spec.Remove.Body
+// RemoveTimedOut returns the remove timeout of rest and whether it has passed at now
+// since rest was marked for deletion
+func RemoveTimedOut(rest templatev1.RESTObject, now time.Time) (time.Duration, bool) {
+	timeout := DefaultRemoveTimeout
+	if rest.GetSpec().RemoveTimeout != nil {
+		timeout = rest.GetSpec().RemoveTimeout.Duration
+	}
+	deleted := rest.GetDeletionTimestamp()
+	if deleted == nil {
+		return timeout, false
+	}
+	return timeout, now.Sub(deleted.Time) > timeout
+}
 
-	_, err := r.doRequest(ctx, rest, url, method, body)
+// recordRequest records the request of resp as the last request of rest and in its
+// history, and emits an event describing it along with err, the error of doRequest
+func (r *RESTManager) recordRequest(rest templatev1.RESTObject, action string, resp *restResponse, err error) {
+	if resp == nil {
+		return
+	}
+	request := resp.Request
+	request.Action = action
+
+	status := rest.GetStatus()
+	status.LastRequest = &request
+	if r.HistoryLimit > 0 {
+		status.History = append(status.History, request)
+		if len(status.History) > r.HistoryLimit {
+			status.History = status.History[len(status.History)-r.HistoryLimit:]
+		}
+	} else {
+		status.History = nil
+	}
+
+	if r.Events == nil {
+		return
+	}
+	message := fmt.Sprintf("%s request %s %s returned status=%d in %v", action, request.Method, request.URL, request.StatusCode, request.Duration.Duration)
 	if err != nil {
-		return errors.Wrap(err, "failed to send request")
+		r.Events.Eventf(rest, v1.EventTypeWarning, "RequestFailed", "%s: %v", message, err)
+	} else {
+		r.Events.Event(rest, v1.EventTypeNormal, "RequestSucceeded", message)
 	}
+}
 
-	fmt.Printf("Received delete request\n")
-	return nil
+// requestHash returns the hash of the update request rendered with the current status,
+// so that templates referencing outputs of the response do not trigger a resync
+func (r *RESTManager) requestHash(rest templatev1.RESTObject) (string, error) {
+	data, err := restTemplateData(rest)
+	if err != nil {
+		return "", err
+	}
+	request, err := r.renderRequest(rest, data, rest.GetSpec().Update)
+	if err != nil {
+		return "", err
+	}
+	return request.hash(), nil
 }
 
-func (r *RESTManager) doRequest(ctx context.Context, rest *templatev1.REST, url, method, body string) ([]byte, error) {
-	newBody, err := r.templateField(rest, body)
+// renderRequest templates the url, body and headers of action using data, falling
+// back to the url of the REST spec if the action does not define one. Credentials
+// and headers read from secrets are resolved into the request and registered for
+// redaction, as are sensitive headers.
+func (r *RESTManager) renderRequest(rest templatev1.RESTObject, data map[string]interface{}, action templatev1.RESTAction) (*restRequest, error) {
+	spec := rest.GetSpec()
+	request := &restRequest{
+		Method:    action.Method,
+		Headers:   map[string]string{},
+		rateLimit: spec.RateLimit,
+		redactor:  &redactor{},
+	}
+	for k, v := range spec.Headers {
+		value, err := r.templateField(request.redactor, data, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to template header %s", k)
+		}
+		request.Headers[k] = value
+	}
+	for _, header := range spec.HeadersFrom {
+		value, err := r.headerValue(rest, data, header, request.redactor)
+		if err != nil {
+			return nil, err
+		}
+		request.Headers[header.Name] = value
+		if header.ValueFrom != nil {
+			request.redactor.add(value)
+		}
+	}
+	for _, name := range spec.SensitiveHeaders {
+		request.redactor.add(request.Headers[name])
+	}
+
+	if spec.Auth != nil {
+		username, password, err := r.getRestAuthorization(rest)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate basic auth")
+		}
+		basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		request.redactor.add(username, password, basicAuth)
+		request.Headers["Authorization"] = basicAuth
+	}
+
+	body, err := r.templateField(request.redactor, data, action.Body)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to template body")
 	}
+	if action.GraphQL != nil {
+		if body, err = r.graphqlBody(request.redactor, data, action.GraphQL); err != nil {
+			return nil, err
+		}
+		if request.Method == "" {
+			request.Method = http.MethodPost
+		}
+		if _, found := request.Headers["Content-Type"]; !found {
+			request.Headers["Content-Type"] = "application/json"
+		}
+		request.graphql = true
+	}
 
-	newURL, err := r.templateField(rest, url)
+	url, err := r.templateField(request.redactor, data, action.URL)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to template url")
 	}
-	if newURL == "" {
-		if rest.Spec.URL == "" {
-			return nil, errors.Wrap(err, "url cannot be empty")
+	if url == "" {
+		if spec.URL == "" {
+			return nil, errors.New("url cannot be empty")
 		}
-		newURL = rest.Spec.URL
+		url = spec.URL
 	}
+	request.URL = url
+	request.Body = body
 
+	return request, nil
+}
+
+// graphqlBody returns the body of a standard GraphQL POST request for query
+func (r *RESTManager) graphqlBody(red *redactor, data map[string]interface{}, query *templatev1.RESTGraphQL) (string, error) {
+	request := map[string]interface{}{"query": query.Query}
+	if query.Variables != "" {
+		variables, err := r.templateField(red, data, query.Variables)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to template graphql variables")
+		}
+		decoded := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(variables), &decoded); err != nil {
+			return "", errors.Wrap(err, "graphql variables must be a JSON object")
+		}
+		request["variables"] = decoded
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal graphql request")
+	}
+	return string(body), nil
+}
+
+// headerValue templates the value of header, or reads it from the secret or config
+// map it references
+func (r *RESTManager) headerValue(rest templatev1.RESTObject, data map[string]interface{}, header kommons.EnvVar, red *redactor) (string, error) {
+	if header.ValueFrom == nil {
+		value, err := r.templateField(red, data, header.Value)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to template header %s", header.Name)
+		}
+		return value, nil
+	}
+
+	namespace, err := authNamespace(rest)
+	if err != nil {
+		return "", err
+	}
+	if namespace == "" {
+		return "", errors.Errorf("auth.namespace is required to read header %s from a secret or config map", header.Name)
+	}
+	_, value, err := r.envValue(header, namespace)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get value of header %s", header.Name)
+	}
+	return value, nil
+}
+
+// doRequest sends a rendered request. The returned response is set whenever the
+// request was sent, even if the remote API answered with an error. Known secret
+// values are redacted from logs, errors and the recorded request.
+func (r *RESTManager) doRequest(ctx context.Context, request *restRequest) (*restResponse, error) {
+	ctx, span := tracer.Start(ctx, "RESTManager.doRequest", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.method", request.Method),
+		attribute.String("http.url", request.redactor.redact(request.URL)),
+	))
+	response, err := r.sendRequest(ctx, request)
+	if response != nil {
+		span.SetAttributes(attribute.Int("http.status_code", response.Request.StatusCode))
+	}
+	endSpan(span, err)
+	return response, err
+}
+
+// sendRequest sends request with the trace context of ctx propagated in its headers
+func (r *RESTManager) sendRequest(ctx context.Context, request *restRequest) (*restResponse, error) {
+	red := request.redactor
 	client := &http.Client{}
 
 	// set the HTTP method, url, and request body
-	req, err := http.NewRequest(method, newURL, bytes.NewBuffer([]byte(newBody)))
+	req, err := http.NewRequestWithContext(ctx, request.Method, request.URL, bytes.NewBuffer([]byte(request.Body)))
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create request")
+		return nil, errors.New(red.redact(errors.Wrap(err, "failed to create request").Error()))
 	}
 
-	if rest.Spec.Headers != nil {
-		for k, v := range rest.Spec.Headers {
-			req.Header.Set(k, v)
-		}
+	for k, v := range request.Headers {
+		req.Header.Set(k, v)
 	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	if rest.Spec.Auth != nil {
-		basicAuth, err := getRestAuthorization(r.Client, rest.Spec.Auth)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to generate basic auth")
-		}
-		req.Header.Set("Authorization", basicAuth)
+	if err := r.RateLimiter.Wait(ctx, req.URL.Host, request.rateLimit); err != nil {
+		return nil, errors.Wrap(err, "failed to wait for rate limiter")
 	}
 
-	r.Log.V(3).Info("Sending Request:", "url", newURL, "method", method, "body", newBody)
+	r.Log.V(3).Info("Sending Request:", "url", red.redact(request.URL), "method", request.Method, "body", red.truncate(request.Body))
+
+	response := &restResponse{
+		Request: templatev1.RESTRequestStatus{
+			Method: request.Method,
+			URL:    red.redact(request.URL),
+			Time:   metav1.Now(),
+		},
+		graphql:  request.graphql,
+		redactor: red,
+	}
 
 	resp, err := client.Do(req)
+	response.Request.Duration = metav1.Duration{Duration: time.Since(response.Request.Time.Time).Round(time.Millisecond)}
 	if err != nil {
-		return nil, errors.Wrap(err, "http request failed")
+		observeRESTRequest(req.URL.Host, 0, response.Request.Duration.Duration)
+		// the error of the http client includes the url
+		return response, errors.Errorf("http request failed: %s", red.redact(err.Error()))
 	}
+	observeRESTRequest(req.URL.Host, resp.StatusCode, response.Request.Duration.Duration)
 	defer resp.Body.Close()
 
+	response.Request.StatusCode = resp.StatusCode
+	response.Header = resp.Header
 	r.Log.V(3).Info("Response:", "statusCode", resp.StatusCode)
 
 	bodyBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read response body")
+		return response, errors.Wrap(err, "failed to read response body")
 	}
+	response.Body = bodyBytes
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, errors.Errorf("expected response status 2xx, received status=%d body=%s", resp.StatusCode, string(bodyBytes))
+		return response, errors.Errorf("expected response status 2xx, received status=%d body=%s", resp.StatusCode, red.truncate(string(bodyBytes)))
+	}
+	if request.graphql {
+		if err := response.graphqlError(); err != nil {
+			return response, errors.New(red.truncate(err.Error()))
+		}
 	}
 
-	return bodyBytes, nil
+	return response, nil
 }
 
-func (r *RESTManager) templateField(rest *templatev1.REST, field string) (string, error) {
-	t, err := template.New("patch").Option("missingkey=zero").Funcs(r.FuncMap).Parse(field)
+// templateOutputs returns the status and jsonPath fields of action extracted from resp.
+// Known secret values are redacted, and sensitive fields are not returned at all.
+func (r *RESTManager) templateOutputs(data map[string]interface{}, resp *restResponse, action templatev1.RESTAction) (map[string]string, error) {
+	response := resp.templateData()
+	outputs := map[string]string{}
+	for k, v := range action.Status {
+		value, err := r.templateResponse(resp.redactor, data, response, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to template status field %s", k)
+		}
+		outputs[k] = value
+	}
+	for k, v := range action.JSONPath {
+		value, err := getJSONPath(response, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get jsonPath for status field %s", k)
+		}
+		if value.IsObject() || value.IsArray() {
+			outputs[k] = value.Raw
+		} else {
+			outputs[k] = value.String()
+		}
+	}
+	for k, v := range outputs {
+		outputs[k] = resp.redactor.redact(v)
+	}
+	for _, k := range action.Sensitive {
+		if _, found := outputs[k]; found {
+			outputs[k] = redactedValue
+		}
+	}
+	return outputs, nil
+}
+
+// templateField templates field with data, values read with kget are registered with
+// red, if set
+func (r *RESTManager) templateField(red *redactor, data map[string]interface{}, field string) (string, error) {
+	t, err := template.New("patch").Option("missingkey=zero").Funcs(r.funcMap(red)).Parse(field)
 	// supress/ignore error if it contains text "map has no entry for key" as missingkey=zero doesn't work currently on map[string]interface{}
 	// workaround for: https://github.com/golang/go/issues/24963
 	if err != nil && !strings.Contains(err.Error(), "map has no entry for key") {
@@ -162,16 +470,6 @@ func (r *RESTManager) templateField(rest *templatev1.REST, field string) (string
 	}
 
 	var tpl bytes.Buffer
-	unstructuredData, err := kommons.ToUnstructured(&unstructured.Unstructured{}, rest)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to convert rest to unstructured")
-	}
-	data := unstructuredData.Object
-
-	if data["status"] == nil {
-		data["status"] = map[string]interface{}{}
-	}
-
 	if err := t.Execute(&tpl, data); err != nil {
 		return "", errors.Wrap(err, "failed to execute template")
 	}
@@ -179,59 +477,175 @@ func (r *RESTManager) templateField(rest *templatev1.REST, field string) (string
 	return tpl.String(), nil
 }
 
-func (r *RESTManager) templateStatus(rest *templatev1.REST, response map[string]interface{}, field string) (string, error) {
-	t, err := template.New("patch").Option("missingkey=zero").Funcs(r.FuncMap).Parse(field)
-	// supress/ignore error if it contains text "map has no entry for key" as missingkey=zero doesn't work currently on map[string]interface{}
-	// workaround for: https://github.com/golang/go/issues/24963
-	if err != nil && !strings.Contains(err.Error(), "map has no entry for key") {
-		return "", errors.Wrap(err, "failed to create template from field")
+// funcMap returns the functions available in templates. kget is restricted to
+// Namespace if set, and the values it reads are registered with red
+func (r *RESTManager) funcMap(red *redactor) template.FuncMap {
+	if r.Namespace == "" && red == nil {
+		return r.FuncMap
+	}
+	funcs := template.FuncMap{}
+	for k, v := range r.FuncMap {
+		funcs[k] = v
 	}
+	kget, _ := r.FuncMap["kget"].(func(string, string) string)
+	funcs["kget"] = func(path, jsonpath string) (string, error) {
+		if parts := strings.Split(path, "/"); r.Namespace != "" && (len(parts) != 3 || parts[1] != r.Namespace) {
+			return "", errors.Errorf("kget %s is not allowed, namespaced objects can only reference their own namespace %s", path, r.Namespace)
+		}
+		if kget == nil {
+			return "", errors.New("kget is not available")
+		}
+		value := kget(path, jsonpath)
+		red.add(value)
+		return value, nil
+	}
+	return funcs
+}
 
-	var tpl bytes.Buffer
+// templateResponse templates field with data and the response available as .response
+func (r *RESTManager) templateResponse(red *redactor, data, response map[string]interface{}, field string) (string, error) {
+	withResponse := map[string]interface{}{}
+	for k, v := range data {
+		withResponse[k] = v
+	}
+	withResponse["response"] = response
+
+	return r.templateField(red, withResponse, field)
+}
 
+// restTemplateData returns the REST object as a map to be used in templates. Outputs
+// are also available directly under .status, so templates written against the
+// flat status map of previous versions (e.g. .status.silenceID) keep working.
+func restTemplateData(rest templatev1.RESTObject) (map[string]interface{}, error) {
 	unstructuredData, err := kommons.ToUnstructured(&unstructured.Unstructured{}, rest)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to convert rest to unstructured")
+		return nil, errors.Wrap(err, "failed to convert rest to unstructured")
 	}
 	data := unstructuredData.Object
-	data["response"] = response
 
-	if err := t.Execute(&tpl, data); err != nil {
-		return "", errors.Wrap(err, "failed to execute template")
+	status, ok := data["status"].(map[string]interface{})
+	if !ok {
+		status = map[string]interface{}{}
+		data["status"] = status
+	}
+	for k, v := range rest.GetStatus().Outputs {
+		if _, found := status[k]; !found {
+			status[k] = v
+		}
 	}
 
-	return tpl.String(), nil
+	return data, nil
 }
 
-func sameGeneration(rest *templatev1.REST) bool {
-	if rest.Status == nil {
-		return false
+func mergeOutputs(status *templatev1.RESTStatus, outputs map[string]string) {
+	if status.Outputs == nil {
+		status.Outputs = map[string]string{}
 	}
+	for k, v := range outputs {
+		status.Outputs[k] = v
+	}
+}
 
-	observedGeneration := rest.Status["observedGeneration"]
+// sameGeneration returns whether the update request was sent for the current
+// generation, a migrated status missing outputs is treated as never sent
+func sameGeneration(rest templatev1.RESTObject) bool {
+	observedGeneration := rest.GetStatus().ObservedGeneration
+	return observedGeneration != 0 && observedGeneration == rest.GetGeneration() && !outputsMissing(rest)
+}
 
-	if observedGeneration == "" {
-		return false
+// envValue returns the value of the secret or config map referenced by input
+func (r *RESTManager) envValue(input kommons.EnvVar, namespace string) (string, string, error) {
+	if r.EnvValue != nil {
+		return r.EnvValue(input, namespace)
 	}
+	return r.Client.GetEnvValue(input, namespace)
+}
 
-	gen, err := strconv.ParseInt(observedGeneration, 10, 64)
+// getRestAuthorization returns the username and password of the REST auth
+func (r *RESTManager) getRestAuthorization(rest templatev1.RESTObject) (string, string, error) {
+	auth := rest.GetSpec().Auth
+	namespace, err := authNamespace(rest)
 	if err != nil {
-		return false
+		return "", "", err
+	}
+	_, username, err := r.envValue(kommons.EnvVar{Name: "username", ValueFrom: &auth.Username}, namespace)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to get username value")
+	}
+	_, password, err := r.envValue(kommons.EnvVar{Name: "password", ValueFrom: &auth.Password}, namespace)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to get password value")
 	}
+	return username, password, nil
+}
 
-	return gen == rest.ObjectMeta.Generation
+// RESTReferences returns the names of the secrets and config maps referenced by auth,
+// headersFrom and callback, and the namespace they are resolved in
+func RESTReferences(rest templatev1.RESTObject) (namespace string, secrets, configMaps []string, err error) {
+	if namespace, err = authNamespace(rest); err != nil {
+		return "", nil, nil, err
+	}
+
+	spec := rest.GetSpec()
+	sources := []*kommons.EnvVarSource{}
+	if spec.Auth != nil {
+		sources = append(sources, &spec.Auth.Username, &spec.Auth.Password)
+	}
+	for _, header := range spec.HeadersFrom {
+		sources = append(sources, header.ValueFrom)
+	}
+	if spec.Callback != nil {
+		sources = append(sources, spec.Callback.Token, spec.Callback.HMAC)
+	}
+
+	for _, source := range sources {
+		if source == nil {
+			continue
+		}
+		if source.SecretKeyRef != nil {
+			secrets = append(secrets, source.SecretKeyRef.Name)
+		}
+		if source.ConfigMapKeyRef != nil {
+			configMaps = append(configMaps, source.ConfigMapKeyRef.Name)
+		}
+	}
+	return namespace, secrets, configMaps, nil
 }
 
-func getRestAuthorization(client *kommons.Client, auth *templatev1.RESTAuth) (string, error) {
-	_, username, err := client.GetEnvValue(kommons.EnvVar{Name: "username", ValueFrom: &auth.Username}, auth.Namespace)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get username value")
+// ResyncOnChange returns whether rest has resyncOnChange set and references the
+// secret, or config map if secret is false, named name in namespace
+func ResyncOnChange(rest templatev1.RESTObject, namespace, name string, secret bool) bool {
+	if !rest.GetSpec().ResyncOnChange {
+		return false
 	}
-	_, password, err := client.GetEnvValue(kommons.EnvVar{Name: "password", ValueFrom: &auth.Password}, auth.Namespace)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get username value")
+	referencesNamespace, secrets, configMaps, err := RESTReferences(rest)
+	if err != nil || referencesNamespace != namespace {
+		return false
+	}
+	names := configMaps
+	if secret {
+		names = secrets
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
 	}
+	return false
+}
 
-	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
-	return basicAuth, nil
+// authNamespace returns the namespace in which secrets and config maps referenced by
+// the REST object are resolved. Namespaced objects may only use their own namespace
+func authNamespace(rest templatev1.RESTObject) (string, error) {
+	namespace := ""
+	if auth := rest.GetSpec().Auth; auth != nil {
+		namespace = auth.Namespace
+	}
+	if rest.GetNamespace() == "" {
+		return namespace, nil
+	}
+	if namespace != "" && namespace != rest.GetNamespace() {
+		return "", errors.Errorf("auth.namespace %s is not allowed, namespaced objects can only reference their own namespace %s", namespace, rest.GetNamespace())
+	}
+	return rest.GetNamespace(), nil
 }
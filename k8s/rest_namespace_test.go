@@ -0,0 +1,67 @@
+package k8s_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"text/template"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("NamespacedREST", func() {
+	var api *httptest.Server
+	var body string
+
+	BeforeEach(func() {
+		body = ""
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			data, _ := ioutil.ReadAll(req.Body)
+			body = string(data)
+		}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	namespacedREST := func(kget string) *templatev1.NamespacedREST {
+		return &templatev1.NamespacedREST{
+			ObjectMeta: metav1.ObjectMeta{Name: "kget", Namespace: "team-a", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL: api.URL,
+				Update: templatev1.RESTAction{
+					Method: http.MethodPost,
+					Body:   `{{ kget "` + kget + `" "data.token" }}`,
+				},
+			},
+		}
+	}
+
+	restManager := func() *k8s.RESTManager {
+		return &k8s.RESTManager{
+			Log:       testLog,
+			Namespace: "team-a",
+			FuncMap: template.FuncMap{
+				"kget": func(path, jsonpath string) string { return "token of " + path },
+			},
+		}
+	}
+
+	It("Allows kget in its own namespace", func() {
+		Expect(restManager().Update(context.Background(), namespacedREST("secret/team-a/creds"))).To(Succeed())
+		Expect(body).To(Equal("token of secret/team-a/creds"))
+	})
+
+	It("Rejects kget in other namespaces", func() {
+		err := restManager().Update(context.Background(), namespacedREST("secret/team-b/creds"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("can only reference their own namespace team-a"))
+		Expect(body).To(BeEmpty())
+	})
+})
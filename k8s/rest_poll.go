@@ -0,0 +1,101 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultPollInterval = 10 * time.Second
+	defaultPollTimeout  = 10 * time.Minute
+)
+
+// Poll sends the poll request of the update action while status.poll is in progress,
+// recording the outcome on rest.Status. It returns the duration after which to poll
+// again, or 0 once polling completed or is not configured.
+func (r *RESTManager) Poll(ctx context.Context, rest templatev1.RESTObject) (time.Duration, error) {
+	poll := rest.GetSpec().Update.Poll
+	status := rest.GetStatus()
+	if poll == nil || status.Poll == nil || status.Poll.Phase != templatev1.RESTPollPolling {
+		return 0, nil
+	}
+
+	interval, timeout := defaultPollInterval, defaultPollTimeout
+	if poll.Interval != nil {
+		interval = poll.Interval.Duration
+	}
+	if poll.Timeout != nil {
+		timeout = poll.Timeout.Duration
+	}
+	if time.Since(status.Poll.StartTime.Time) > timeout {
+		status.Poll.Phase = templatev1.RESTPollFailed
+		status.Poll.Message = fmt.Sprintf("timed out after %v", timeout)
+		return 0, nil
+	}
+	// reconciles triggered by other changes, e.g. the status update of the last
+	// attempt, wait for the rest of the interval
+	if last := status.Poll.LastPollTime; last != nil {
+		if remaining := interval - time.Since(last.Time); remaining > 0 {
+			return remaining, nil
+		}
+	}
+
+	data, err := restTemplateData(rest)
+	if err != nil {
+		return 0, err
+	}
+	request, err := r.renderRequest(rest, data, templatev1.RESTAction{Method: http.MethodGet, URL: poll.URL})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to render poll request")
+	}
+
+	status.Poll.Attempts++
+	now := metav1.Now()
+	status.Poll.LastPollTime = &now
+	resp, err := r.doRequest(ctx, request)
+	r.recordRequest(rest, restActionPoll, resp, err)
+	if err != nil {
+		// the operation may not be visible yet, keep polling until the timeout
+		status.Poll.Message = err.Error()
+		return interval, nil
+	}
+
+	outputs, err := r.templateOutputs(data, resp, templatev1.RESTAction{Status: poll.Status, JSONPath: poll.JSONPath, Sensitive: rest.GetSpec().Update.Sensitive})
+	if err != nil {
+		return 0, err
+	}
+	mergeOutputs(status, outputs)
+
+	response := resp.templateData()
+	if poll.Failure != "" {
+		failed, err := r.templateResponse(resp.redactor, data, response, poll.Failure)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to template poll failure")
+		}
+		if strings.TrimSpace(failed) == "true" {
+			status.Poll.Phase = templatev1.RESTPollFailed
+			status.Poll.Message = "failure condition met"
+			return 0, nil
+		}
+	}
+
+	succeeded, err := r.templateResponse(resp.redactor, data, response, poll.Success)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to template poll success")
+	}
+	if strings.TrimSpace(succeeded) != "true" {
+		status.Poll.Message = "waiting for success condition"
+		return interval, nil
+	}
+
+	status.Poll.Phase = templatev1.RESTPollSucceeded
+	status.Poll.Message = ""
+	return 0, nil
+}
@@ -0,0 +1,86 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTPoll", func() {
+	var requests int32
+	var api *httptest.Server
+
+	BeforeEach(func() {
+		requests = 0
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"state": "pending"}`)) // nolint: errcheck
+		}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	polling := func() *templatev1.REST {
+		return &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "poll", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL: api.URL,
+				Update: templatev1.RESTAction{
+					Method: http.MethodPost,
+					Poll: &templatev1.RESTPoll{
+						URL:      api.URL,
+						Interval: &metav1.Duration{Duration: time.Minute},
+						Success:  `{{ eq .response.state "done" }}`,
+					},
+				},
+			},
+			Status: templatev1.RESTStatus{
+				ObservedGeneration: 1,
+				Poll:               &templatev1.RESTPollStatus{Phase: templatev1.RESTPollPolling, StartTime: metav1.Now()},
+			},
+		}
+	}
+
+	It("Respects the interval between poll requests", func() {
+		rest := polling()
+		restManager := &k8s.RESTManager{Log: testLog}
+
+		requeueAfter, err := restManager.Poll(context.Background(), rest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(requeueAfter).To(Equal(time.Minute))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		Expect(rest.Status.Poll.Attempts).To(Equal(1))
+		Expect(rest.Status.Poll.LastPollTime).ToNot(BeNil())
+
+		// e.g. triggered by the status update of the first attempt
+		requeueAfter, err = restManager.Poll(context.Background(), rest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(requeueAfter).To(BeNumerically(">", 0))
+		Expect(requeueAfter).To(BeNumerically("<=", time.Minute))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		Expect(rest.Status.Poll.Attempts).To(Equal(1))
+	})
+
+	It("Polls again once the interval passed", func() {
+		rest := polling()
+		rest.Status.Poll.Attempts = 1
+		rest.Status.Poll.LastPollTime = &metav1.Time{Time: time.Now().Add(-2 * time.Minute)}
+
+		restManager := &k8s.RESTManager{Log: testLog}
+		_, err := restManager.Poll(context.Background(), rest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		Expect(rest.Status.Poll.Attempts).To(Equal(2))
+	})
+})
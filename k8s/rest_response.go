@@ -0,0 +1,185 @@
+package k8s
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+)
+
+type restRequest struct {
+	Method  string
+	URL     string
+	Body    string
+	Headers map[string]string
+
+	graphql   bool
+	rateLimit *templatev1.RESTRateLimit
+	redactor  *redactor
+}
+
+// hash returns a digest of the rendered request, used to detect changes
+func (r *restRequest) hash() string {
+	keys := make([]string, 0, len(r.Headers))
+	for k := range r.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Method, r.URL, r.Body)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s: %s\n", k, r.Headers[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type restResponse struct {
+	Request templatev1.RESTRequestStatus
+	Header  http.Header
+	Body    []byte
+
+	graphql  bool
+	redactor *redactor
+}
+
+// templateData returns the response as exposed to status templates under .response.
+// Fields of a JSON or XML object body are available at the top level for
+// compatibility, body, raw, headers and statusCode take precedence over them.
+func (r *restResponse) templateData() map[string]interface{} {
+	body := r.decodeBody()
+	if m, ok := body.(map[string]interface{}); ok && r.graphql {
+		body = m["data"]
+	}
+
+	headers := map[string]interface{}{}
+	for k := range r.Header {
+		headers[k] = r.Header.Get(k)
+	}
+
+	data := map[string]interface{}{}
+	if m, ok := body.(map[string]interface{}); ok {
+		for k, v := range m {
+			data[k] = v
+		}
+	}
+	data["body"] = body
+	data["raw"] = string(r.Body)
+	data["headers"] = headers
+	data["statusCode"] = r.Request.StatusCode
+	return data
+}
+
+// graphqlError returns the errors of a GraphQL response
+func (r *restResponse) graphqlError() error {
+	response := struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if err := json.Unmarshal(r.Body, &response); err != nil {
+		return errors.Wrap(err, "failed to decode graphql response")
+	}
+	if len(response.Errors) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, e := range response.Errors {
+		messages = append(messages, e.Message)
+	}
+	return errors.Errorf("graphql request failed: %s", strings.Join(messages, "; "))
+}
+
+// decodeBody decodes a JSON or XML body, falling back to the body as plain text
+func (r *restResponse) decodeBody() interface{} {
+	if len(bytes.TrimSpace(r.Body)) == 0 {
+		return nil
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(r.Body, &body); err == nil {
+		return body
+	}
+
+	if strings.Contains(r.Header.Get("Content-Type"), "xml") || bytes.HasPrefix(bytes.TrimSpace(r.Body), []byte("<")) {
+		if body, err := xmlToMap(r.Body); err == nil {
+			return body
+		}
+	}
+
+	return string(r.Body)
+}
+
+// xmlToMap converts an XML document into a map keyed by element name. Attributes are
+// stored with a "-" prefix, repeated elements become lists and the text of elements
+// which also have attributes or children is stored under "#text"
+func xmlToMap(data []byte) (map[string]interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, errors.New("no root element found")
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode xml")
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			value, err := decodeXMLElement(decoder, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: value}, nil
+		}
+	}
+}
+
+func decodeXMLElement(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	node := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		node["-"+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode xml element %s", start.Name.Local)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(decoder, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			if existing, found := node[name]; !found {
+				node[name] = child
+			} else if list, ok := existing.([]interface{}); ok {
+				node[name] = append(list, child)
+			} else {
+				node[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			value := strings.TrimSpace(text.String())
+			if len(node) == 0 {
+				return value, nil
+			}
+			if value != "" {
+				node["#text"] = value
+			}
+			return node, nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTResponse", func() {
+	It("Converts XML documents to maps", func() {
+		data, err := k8s.XMLToMap([]byte(`<?xml version="1.0"?>
+<silence id="abc">
+  <matcher name="alertname">Watchdog</matcher>
+  <comment>first</comment>
+  <comment>second</comment>
+  <createdBy>operator</createdBy>
+</silence>`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal(map[string]interface{}{
+			"silence": map[string]interface{}{
+				"-id": "abc",
+				"matcher": map[string]interface{}{
+					"-name": "alertname",
+					"#text": "Watchdog",
+				},
+				"comment":   []interface{}{"first", "second"},
+				"createdBy": "operator",
+			},
+		}))
+	})
+
+	It("Fails on documents without a root element", func() {
+		_, err := k8s.XMLToMap([]byte(`<?xml version="1.0"?>`))
+		Expect(err).To(HaveOccurred())
+
+		_, err = k8s.XMLToMap([]byte(`<silence><id>abc</silence>`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Decodes XML bodies without a content type", func() {
+		data := k8s.ResponseTemplateData(http.Header{}, []byte(`<item><id>1</id></item>`), false)
+		Expect(data["item"]).To(Equal(map[string]interface{}{"id": "1"}))
+		Expect(data["body"]).To(Equal(map[string]interface{}{"item": map[string]interface{}{"id": "1"}}))
+	})
+
+	It("Falls back to plain text for invalid XML", func() {
+		data := k8s.ResponseTemplateData(http.Header{"Content-Type": {"application/xml"}}, []byte(`<item>`), false)
+		Expect(data["body"]).To(Equal("<item>"))
+		Expect(data["raw"]).To(Equal("<item>"))
+	})
+
+	It("Gives body, raw, headers and statusCode precedence over fields of the body", func() {
+		header := http.Header{"X-Request-Id": {"1"}}
+		data := k8s.ResponseTemplateData(header, []byte(`{"data": {"body": "field", "raw": "field", "id": "2"}}`), true)
+		Expect(data["id"]).To(Equal("2"))
+		Expect(data["body"]).To(Equal(map[string]interface{}{"body": "field", "raw": "field", "id": "2"}))
+		Expect(data["raw"]).To(Equal(`{"data": {"body": "field", "raw": "field", "id": "2"}}`))
+		Expect(data["headers"]).To(Equal(map[string]interface{}{"X-Request-Id": "1"}))
+		Expect(data["statusCode"]).To(Equal(0))
+	})
+
+	It("Returns the errors of GraphQL responses", func() {
+		Expect(k8s.GraphQLError([]byte(`{"data": {"id": "1"}}`))).To(Succeed())
+		Expect(k8s.GraphQLError([]byte(`{"data": null, "errors": []}`))).To(Succeed())
+
+		err := k8s.GraphQLError([]byte(`{"errors": [{"message": "not found"}, {"message": "forbidden"}]}`))
+		Expect(err).To(MatchError("graphql request failed: not found; forbidden"))
+
+		Expect(k8s.GraphQLError([]byte(`not json`))).To(HaveOccurred())
+	})
+
+	It("Templates outputs from XML responses", func() {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<silence id="abc"><state>active</state></silence>`)) // nolint: errcheck
+		}))
+		defer api.Close()
+
+		rest := &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "xml", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL: api.URL,
+				Update: templatev1.RESTAction{
+					Method: http.MethodPost,
+					Status: map[string]string{
+						"id":    `{{ index .response.silence "-id" }}`,
+						"state": "{{ .response.silence.state }}",
+					},
+					JSONPath: map[string]string{"path": "body.silence.state"},
+				},
+			},
+		}
+		restManager := &k8s.RESTManager{Log: testLog}
+		Expect(restManager.Update(context.Background(), rest)).To(Succeed())
+
+		Expect(rest.Status.Outputs).To(Equal(map[string]string{"id": "abc", "state": "active", "path": "active"}))
+	})
+})
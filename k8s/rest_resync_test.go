@@ -0,0 +1,107 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flanksource/kommons"
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTResyncOnChange", func() {
+	var api *httptest.Server
+	var tokens []string
+	var token string
+
+	BeforeEach(func() {
+		tokens = nil
+		token = "first"
+		api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			tokens = append(tokens, req.Header.Get("X-Token"))
+		}))
+	})
+
+	AfterEach(func() {
+		api.Close()
+	})
+
+	restManager := func() *k8s.RESTManager {
+		return &k8s.RESTManager{
+			Log: testLog,
+			EnvValue: func(input kommons.EnvVar, namespace string) (string, string, error) {
+				Expect(namespace).To(Equal("default"))
+				return input.Name, token, nil
+			},
+		}
+	}
+
+	rest := func(resync bool) *templatev1.NamespacedREST {
+		return &templatev1.NamespacedREST{
+			ObjectMeta: metav1.ObjectMeta{Name: "resync", Namespace: "default", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL:            api.URL,
+				ResyncOnChange: resync,
+				HeadersFrom: []kommons.EnvVar{{
+					Name: "X-Token",
+					ValueFrom: &kommons.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: "token"},
+						Key:                  "token",
+					}},
+				}, {
+					Name: "X-Region",
+					ValueFrom: &kommons.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: "settings"},
+						Key:                  "region",
+					}},
+				}},
+				Update: templatev1.RESTAction{Method: http.MethodPost, Body: "{}"},
+			},
+		}
+	}
+
+	It("Re-sends the update request when a referenced value changed", func() {
+		r := rest(true)
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+		Expect(tokens).To(Equal([]string{"first"}))
+
+		token = "second"
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+		Expect(tokens).To(Equal([]string{"first", "second"}))
+	})
+
+	It("Does not re-send the update request when referenced values did not change", func() {
+		r := rest(true)
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+		Expect(tokens).To(Equal([]string{"first"}))
+	})
+
+	It("Does not re-send the update request without resyncOnChange", func() {
+		r := rest(false)
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+
+		token = "second"
+		Expect(restManager().Update(context.Background(), r)).To(Succeed())
+		Expect(tokens).To(Equal([]string{"first"}))
+	})
+
+	It("Enqueues objects with resyncOnChange referencing the changed secret or config map", func() {
+		r := rest(true)
+		Expect(k8s.ResyncOnChange(r, "default", "token", true)).To(BeTrue())
+		Expect(k8s.ResyncOnChange(r, "default", "settings", false)).To(BeTrue())
+
+		Expect(k8s.ResyncOnChange(r, "default", "token", false)).To(BeFalse())
+		Expect(k8s.ResyncOnChange(r, "default", "settings", true)).To(BeFalse())
+		Expect(k8s.ResyncOnChange(r, "default", "other", true)).To(BeFalse())
+		Expect(k8s.ResyncOnChange(r, "other", "token", true)).To(BeFalse())
+
+		Expect(k8s.ResyncOnChange(rest(false), "default", "token", true)).To(BeFalse())
+		Expect(k8s.ResyncOnChange(rest(false), "default", "settings", false)).To(BeFalse())
+	})
+})
@@ -0,0 +1,94 @@
+package k8s
+
+import (
+	"reflect"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RESTReasonWaitingForCallback is the reason of the Ready condition of a REST object
+// whose request was sent, until its callback is received
+const RESTReasonWaitingForCallback = "WaitingForCallback"
+
+// WaitingForCallback returns true if conditions hold no callback outcome for generation
+func WaitingForCallback(conditions []metav1.Condition, generation int64) bool {
+	condition := meta.FindStatusCondition(conditions, templatev1.RESTConditionReady)
+	if condition == nil || condition.ObservedGeneration != generation {
+		return true
+	}
+	switch condition.Reason {
+	case "CallbackSucceeded", "CallbackReceived", "CallbackFailed":
+		return false
+	}
+	return true
+}
+
+// MergeRESTStatus applies the fields of desired that changed since old onto latest,
+// the status of a refetched object. Fields written concurrently, e.g. by a callback,
+// are kept unless this reconcile changed them as well. A callback outcome is never
+// replaced by WaitingForCallback, as the callback landed after the status was read
+func MergeRESTStatus(latest, old, desired *templatev1.RESTStatus) {
+	if desired.ObservedGeneration != old.ObservedGeneration {
+		latest.ObservedGeneration = desired.ObservedGeneration
+	}
+	for _, condition := range desired.Conditions {
+		if condition.Type == templatev1.RESTConditionReady && condition.Reason == RESTReasonWaitingForCallback && !WaitingForCallback(latest.Conditions, condition.ObservedGeneration) {
+			continue
+		}
+		previous := meta.FindStatusCondition(old.Conditions, condition.Type)
+		if previous == nil || !reflect.DeepEqual(*previous, condition) {
+			meta.SetStatusCondition(&latest.Conditions, condition)
+		}
+	}
+	for _, condition := range old.Conditions {
+		if meta.FindStatusCondition(desired.Conditions, condition.Type) == nil {
+			meta.RemoveStatusCondition(&latest.Conditions, condition.Type)
+		}
+	}
+	if !reflect.DeepEqual(desired.LastRequest, old.LastRequest) {
+		latest.LastRequest = desired.LastRequest.DeepCopy()
+	}
+	if !reflect.DeepEqual(desired.History, old.History) {
+		latest.History = append([]templatev1.RESTRequestStatus(nil), desired.History...)
+	}
+	if desired.RequestHash != old.RequestHash {
+		latest.RequestHash = desired.RequestHash
+	}
+	for k, v := range desired.Outputs {
+		if previous, found := old.Outputs[k]; !found || previous != v {
+			if latest.Outputs == nil {
+				latest.Outputs = map[string]string{}
+			}
+			latest.Outputs[k] = v
+		}
+	}
+	for k := range old.Outputs {
+		if _, found := desired.Outputs[k]; !found {
+			delete(latest.Outputs, k)
+		}
+	}
+	if !reflect.DeepEqual(desired.Poll, old.Poll) {
+		latest.Poll = desired.Poll.DeepCopy()
+	}
+}
+
+// outputsMissing returns whether a status written by a previous version of the
+// operator lacks any of the outputs of the update action, the update request is
+// re-sent in that case to rebuild them
+func outputsMissing(rest templatev1.RESTObject) bool {
+	status := rest.GetStatus()
+	if !status.IsLegacy() {
+		return false
+	}
+	update := rest.GetSpec().Update
+	for _, fields := range []map[string]string{update.Status, update.JSONPath} {
+		for k := range fields {
+			if _, found := status.Outputs[k]; !found {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package k8s_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTStatus", func() {
+	It("Migrates the flat status of previous versions to outputs", func() {
+		status := templatev1.RESTStatus{}
+		Expect(json.Unmarshal([]byte(`{"observedGeneration": "2", "lastUpdated": "2021-01-01T00:00:00Z", "silenceID": "abc"}`), &status)).To(Succeed())
+
+		Expect(status.IsLegacy()).To(BeTrue())
+		Expect(status.ObservedGeneration).To(Equal(int64(2)))
+		Expect(status.Outputs).To(Equal(map[string]string{"silenceID": "abc"}))
+	})
+
+	It("Ignores unknown fields of a structured status", func() {
+		status := templatev1.RESTStatus{}
+		Expect(json.Unmarshal([]byte(`{"observedGeneration": 2, "requestHash": "h", "newField": "value"}`), &status)).To(Succeed())
+
+		Expect(status.IsLegacy()).To(BeFalse())
+		Expect(status.ObservedGeneration).To(Equal(int64(2)))
+		Expect(status.RequestHash).To(Equal("h"))
+		Expect(status.Outputs).To(BeEmpty())
+	})
+
+	It("Re-sends the update request if a migrated status lacks outputs", func() {
+		var requests int32
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "1"}`)) // nolint: errcheck
+		}))
+		defer api.Close()
+
+		rest := legacyREST(api.URL, `{"observedGeneration": "1"}`)
+		restManager := &k8s.RESTManager{Log: testLog}
+		Expect(restManager.Update(context.Background(), rest)).To(Succeed())
+
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		Expect(rest.Status.Outputs["silenceID"]).To(Equal("1"))
+	})
+
+	It("Does not re-send the update request if a migrated status has all outputs", func() {
+		var requests int32
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+		}))
+		defer api.Close()
+
+		rest := legacyREST(api.URL, `{"observedGeneration": "1", "silenceID": "abc"}`)
+		restManager := &k8s.RESTManager{Log: testLog}
+		Expect(restManager.Update(context.Background(), rest)).To(Succeed())
+
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(0)))
+		Expect(rest.Status.Outputs["silenceID"]).To(Equal("abc"))
+	})
+
+	It("Merges only the changed fields onto a refetched status", func() {
+		old := templatev1.RESTStatus{
+			ObservedGeneration: 1,
+			Outputs:            map[string]string{"id": "1", "removed": "x"},
+		}
+		desired := old.DeepCopy()
+		desired.ObservedGeneration = 2
+		desired.Outputs["id"] = "2"
+		delete(desired.Outputs, "removed")
+		meta := metav1.Condition{Type: templatev1.RESTConditionReady, Status: metav1.ConditionTrue, Reason: "Updated"}
+		desired.Conditions = []metav1.Condition{meta}
+
+		// written by a callback in the meantime
+		latest := old.DeepCopy()
+		latest.Outputs["callback"] = "done"
+		latest.RequestHash = "h"
+
+		k8s.MergeRESTStatus(latest, &old, desired)
+		Expect(latest.ObservedGeneration).To(Equal(int64(2)))
+		Expect(latest.RequestHash).To(Equal("h"))
+		Expect(latest.Outputs).To(Equal(map[string]string{"id": "2", "callback": "done"}))
+		Expect(latest.Conditions).To(HaveLen(1))
+		Expect(latest.Conditions[0].Reason).To(Equal("Updated"))
+	})
+
+	It("Keeps a callback outcome received after the status was read", func() {
+		old := templatev1.RESTStatus{ObservedGeneration: 1}
+		desired := old.DeepCopy()
+		desired.ObservedGeneration = 2
+		desired.Conditions = []metav1.Condition{{
+			Type: templatev1.RESTConditionReady, Status: metav1.ConditionFalse, ObservedGeneration: 2, Reason: k8s.RESTReasonWaitingForCallback,
+		}}
+
+		latest := old.DeepCopy()
+		latest.Conditions = []metav1.Condition{{
+			Type: templatev1.RESTConditionReady, Status: metav1.ConditionTrue, ObservedGeneration: 2, Reason: "CallbackSucceeded",
+		}}
+		k8s.MergeRESTStatus(latest, &old, desired)
+		Expect(latest.ObservedGeneration).To(Equal(int64(2)))
+		Expect(latest.Conditions).To(HaveLen(1))
+		Expect(latest.Conditions[0].Reason).To(Equal("CallbackSucceeded"))
+		Expect(k8s.WaitingForCallback(latest.Conditions, 2)).To(BeFalse())
+
+		// the callback of a previous generation does not count
+		latest.Conditions[0].ObservedGeneration = 1
+		k8s.MergeRESTStatus(latest, &old, desired)
+		Expect(latest.Conditions[0].Reason).To(Equal(k8s.RESTReasonWaitingForCallback))
+		Expect(k8s.WaitingForCallback(latest.Conditions, 2)).To(BeTrue())
+	})
+})
+
+// legacyREST returns a REST object whose status was decoded from status, as
+// written by previous versions of the operator
+func legacyREST(url, status string) *templatev1.REST {
+	rest := &templatev1.REST{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Generation: 1},
+		Spec: templatev1.RESTSpec{
+			URL: url,
+			Update: templatev1.RESTAction{
+				Method: http.MethodPost,
+				Body:   "{}",
+				Status: map[string]string{"silenceID": "{{ .response.id }}"},
+			},
+		},
+	}
+	Expect(json.Unmarshal([]byte(status), &rest.Status)).To(Succeed())
+	return rest
+}
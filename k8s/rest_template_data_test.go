@@ -0,0 +1,48 @@
+package k8s_test
+
+import (
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RESTTemplateData", func() {
+	It("Exposes outputs directly under status", func() {
+		rest := &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "data"},
+			Spec:       templatev1.RESTSpec{URL: "http://example.com"},
+			Status: templatev1.RESTStatus{
+				ObservedGeneration: 2,
+				Outputs:            map[string]string{"silenceID": "abc"},
+			},
+		}
+		data, err := k8s.RESTTemplateData(rest)
+		Expect(err).ToNot(HaveOccurred())
+
+		status := data["status"].(map[string]interface{})
+		Expect(status["silenceID"]).To(Equal("abc"))
+		Expect(status["outputs"]).To(Equal(map[string]interface{}{"silenceID": "abc"}))
+		Expect(data["spec"].(map[string]interface{})["url"]).To(Equal("http://example.com"))
+	})
+
+	It("Does not let outputs override status fields", func() {
+		rest := &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "data"},
+			Status: templatev1.RESTStatus{
+				RequestHash: "hash",
+				Outputs:     map[string]string{"requestHash": "output"},
+			},
+		}
+		data, err := k8s.RESTTemplateData(rest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data["status"].(map[string]interface{})["requestHash"]).To(Equal("hash"))
+	})
+
+	It("Returns an empty status without outputs", func() {
+		data, err := k8s.RESTTemplateData(&templatev1.REST{ObjectMeta: metav1.ObjectMeta{Name: "data"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data["status"]).To(BeEmpty())
+	})
+})
@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NewTemplateRevision returns the revision of the current spec of template, named
+// after the template and the hash of the snapshot
+func NewTemplateRevision(template *templatev1.Template) (*templatev1.TemplateRevision, error) {
+	spec := templatev1.TemplateRevisionSpec{
+		Resources:         template.Spec.Resources,
+		ResourcesTemplate: template.Spec.ResourcesTemplate,
+		Patches:           template.Spec.Patches,
+		JsonPatches:       template.Spec.JsonPatches,
+		CopyToNamespaces:  template.Spec.CopyToNamespaces,
+		HTTP:              template.Spec.HTTP,
+		Dependencies:      template.Spec.Dependencies,
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal template revision")
+	}
+	sum := sha256.Sum256(data)
+	spec.Template = template.Name
+	spec.Revision = hex.EncodeToString(sum[:])[:10]
+
+	revision := &templatev1.TemplateRevision{
+		TypeMeta: metav1.TypeMeta{APIVersion: templatev1.GroupVersion.String(), Kind: "TemplateRevision"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   RevisionName(template.Name, spec.Revision),
+			Labels: map[string]string{templatev1.TemplateNameLabel: template.Name},
+		},
+		Spec: *spec.DeepCopy(),
+	}
+	return revision, nil
+}
+
+// RevisionName returns the name of the TemplateRevision of template with hash revision
+func RevisionName(template, revision string) string {
+	return template + "-" + revision
+}
+
+// ApplyRevision replaces the fields of spec snapshotted by revision
+func ApplyRevision(spec *templatev1.TemplateSpec, revision *templatev1.TemplateRevisionSpec) {
+	revision = revision.DeepCopy()
+	spec.Resources = revision.Resources
+	spec.ResourcesTemplate = revision.ResourcesTemplate
+	spec.Patches = revision.Patches
+	spec.JsonPatches = revision.JsonPatches
+	spec.CopyToNamespaces = revision.CopyToNamespaces
+	spec.HTTP = revision.HTTP
+	spec.Dependencies = revision.Dependencies
+}
+
+// EffectiveTemplate returns a copy of template with the pinned revision applied, if
+// any, and the revision of the objects generated by it
+func EffectiveTemplate(template *templatev1.Template, pinned *templatev1.TemplateRevision) (*templatev1.Template, string, error) {
+	effective := template.DeepCopy()
+	if template.Spec.Revision != "" {
+		if pinned == nil || pinned.Spec.Revision != template.Spec.Revision {
+			return nil, "", errors.Errorf("revision %s of template %s not found", template.Spec.Revision, template.Name)
+		}
+		ApplyRevision(&effective.Spec, &pinned.Spec)
+		return effective, pinned.Spec.Revision, nil
+	}
+	revision, err := NewTemplateRevision(template)
+	if err != nil {
+		return nil, "", err
+	}
+	return effective, revision.Spec.Revision, nil
+}
+
+// RevisionsToPrune returns the oldest revisions beyond limit, except the current and
+// the pinned revisions. No revisions are pruned if limit is not positive
+func RevisionsToPrune(revisions []templatev1.TemplateRevision, limit int, current, pinned string) []templatev1.TemplateRevision {
+	if limit <= 0 {
+		return nil
+	}
+	items := append([]templatev1.TemplateRevision{}, revisions...)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].CreationTimestamp.Before(&items[j].CreationTimestamp)
+	})
+	var prune []templatev1.TemplateRevision
+	for i := 0; i < len(items)-limit; i++ {
+		if revision := items[i].Spec.Revision; revision == current || revision == pinned {
+			continue
+		}
+		prune = append(prune, items[i])
+	}
+	return prune
+}
@@ -0,0 +1,133 @@
+package k8s_test
+
+import (
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("Revisions", func() {
+	newTemplate := func(resourcesTemplate string) *templatev1.Template {
+		return &templatev1.Template{
+			ObjectMeta: metav1.ObjectMeta{Name: "configmaps"},
+			Spec: templatev1.TemplateSpec{
+				Source:            templatev1.ResourceSelector{Kind: "Namespace"},
+				ResourcesTemplate: resourcesTemplate,
+			},
+		}
+	}
+
+	It("Hashes the rendering fields of the spec", func() {
+		template := newTemplate("kind: ConfigMap")
+		revision, err := k8s.NewTemplateRevision(template)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(revision.Spec.Revision).To(HaveLen(10))
+		Expect(revision.Name).To(Equal(k8s.RevisionName("configmaps", revision.Spec.Revision)))
+		Expect(revision.Labels).To(HaveKeyWithValue(templatev1.TemplateNameLabel, "configmaps"))
+		Expect(revision.Spec.Template).To(Equal("configmaps"))
+		Expect(revision.Spec.ResourcesTemplate).To(Equal("kind: ConfigMap"))
+
+		// fields outside of the snapshot do not create a new revision
+		template.Spec.Suspend = true
+		template.Spec.Priority = 10
+		same, err := k8s.NewTemplateRevision(template)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(same.Spec.Revision).To(Equal(revision.Spec.Revision))
+
+		changed, err := k8s.NewTemplateRevision(newTemplate("kind: Secret"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed.Spec.Revision).ToNot(Equal(revision.Spec.Revision))
+	})
+
+	Describe("RevisionsToPrune", func() {
+		start := time.Now()
+		newRevision := func(revision string, age int) templatev1.TemplateRevision {
+			return templatev1.TemplateRevision{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              k8s.RevisionName("configmaps", revision),
+					CreationTimestamp: metav1.NewTime(start.Add(-time.Duration(age) * time.Hour)),
+				},
+				Spec: templatev1.TemplateRevisionSpec{Template: "configmaps", Revision: revision},
+			}
+		}
+		names := func(revisions []templatev1.TemplateRevision) []string {
+			var names []string
+			for _, revision := range revisions {
+				names = append(names, revision.Spec.Revision)
+			}
+			return names
+		}
+		revisions := []templatev1.TemplateRevision{
+			newRevision("c", 3),
+			newRevision("e", 1),
+			newRevision("a", 5),
+			newRevision("d", 2),
+			newRevision("b", 4),
+		}
+
+		It("Prunes the oldest revisions beyond the limit", func() {
+			Expect(names(k8s.RevisionsToPrune(revisions, 2, "e", ""))).To(Equal([]string{"a", "b", "c"}))
+			Expect(k8s.RevisionsToPrune(revisions, 5, "e", "")).To(BeEmpty())
+		})
+
+		It("Keeps the current and pinned revisions", func() {
+			Expect(names(k8s.RevisionsToPrune(revisions, 2, "b", "a"))).To(Equal([]string{"c"}))
+		})
+
+		It("Keeps all revisions without a limit", func() {
+			Expect(k8s.RevisionsToPrune(revisions, 0, "e", "")).To(BeEmpty())
+		})
+	})
+
+	Describe("EffectiveTemplate", func() {
+		It("Uses the current spec unless pinned", func() {
+			template := newTemplate("kind: ConfigMap")
+			current, err := k8s.NewTemplateRevision(template)
+			Expect(err).ToNot(HaveOccurred())
+
+			effective, revision, err := k8s.EffectiveTemplate(template, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(revision).To(Equal(current.Spec.Revision))
+			Expect(effective.Spec).To(Equal(template.Spec))
+		})
+
+		It("Applies the pinned revision", func() {
+			pinned, err := k8s.NewTemplateRevision(newTemplate("kind: Secret"))
+			Expect(err).ToNot(HaveOccurred())
+			template := newTemplate("kind: ConfigMap")
+			template.Spec.Revision = pinned.Spec.Revision
+
+			effective, revision, err := k8s.EffectiveTemplate(template, pinned)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(revision).To(Equal(pinned.Spec.Revision))
+			Expect(effective.Spec.ResourcesTemplate).To(Equal("kind: Secret"))
+			Expect(effective.Spec.Source.Kind).To(Equal("Namespace"))
+			Expect(template.Spec.ResourcesTemplate).To(Equal("kind: ConfigMap"))
+		})
+
+		It("Fails if the pinned revision is missing", func() {
+			template := newTemplate("kind: ConfigMap")
+			template.Spec.Revision = "0123456789"
+			_, _, err := k8s.EffectiveTemplate(template, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("Labels generated objects with the revision", func() {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]interface{}{"name": "copy", "namespace": "other", "labels": map[string]interface{}{"app": "db"}},
+		}}
+		(&k8s.TemplateManager{}).SetRevisionLabel(obj)
+		Expect(obj.GetLabels()).To(HaveLen(1))
+
+		(&k8s.TemplateManager{Revision: "0123456789"}).SetRevisionLabel(obj)
+		Expect(obj.GetLabels()).To(Equal(map[string]string{"app": "db", templatev1.TemplateRevisionLabel: "0123456789"}))
+	})
+})
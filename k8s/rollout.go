@@ -0,0 +1,257 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// rolloutCheckInterval is the interval at which the sources of a batch are checked
+const rolloutCheckInterval = 30 * time.Second
+
+// defaultProgressDeadline is the time the sources of a batch have to become ready if
+// the rollout does not set a progress deadline
+const defaultProgressDeadline = 10 * time.Minute
+
+// rollout returns the sources of template to reconcile for the rollout of its current
+// generation, recorded in its status. The sources of the batches started so far are
+// derived from the batch count, along with the sources already handled for the
+// generation, as sources may be added during the rollout. The rollout advances to the
+// next batch once all of them are ready, and halts if any of them is still failed or
+// not ready once the progress deadline of the last batch passed. While a batch is in
+// progress, only its sources that are not ready yet are returned to be checked again
+func (tm *TemplateManager) rollout(template *templatev1.Template, sources []unstructured.Unstructured) ([]unstructured.Unstructured, ctrl.Result, error) {
+	spec := template.Spec.Rollout
+	if spec == nil {
+		template.Status.Rollout = nil
+		tm.allowSources(nil, true)
+		return sources, ctrl.Result{}, nil
+	}
+	status := template.Status.Rollout
+	if status == nil || status.Generation != template.Generation {
+		status = &templatev1.TemplateRolloutStatus{Generation: template.Generation, Phase: templatev1.RolloutProgressing}
+		template.Status.Rollout = status
+	}
+	if status.Phase == templatev1.RolloutCompleted {
+		tm.allowSources(nil, true)
+		return sources, ctrl.Result{}, nil
+	}
+
+	updated, err := rolloutSources(spec, status.Batches, sources, func(source string) bool {
+		state, found := tm.States.Get(source)
+		return found && state.Generation == template.Generation
+	})
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+
+	deadline := defaultProgressDeadline
+	if spec.ProgressDeadline != nil {
+		deadline = spec.ProgressDeadline.Duration
+	}
+	expired := status.LastBatchTime != nil && time.Since(status.LastBatchTime.Time) > deadline
+
+	var pending []unstructured.Unstructured
+	status.Ready = 0
+	for _, source := range updated {
+		key := sourceKeyOf(source)
+		state, found := tm.States.Get(key)
+		if !found || state.Generation != template.Generation {
+			pending = append(pending, source)
+			if expired {
+				tm.haltRollout(template, status, fmt.Sprintf("source %s was not updated within %s", key, deadline))
+			}
+			continue
+		}
+		switch state.Reason {
+		case SourceReasonReady:
+			status.Ready++
+		case SourceReasonFailed:
+			// a failed source may recover until the progress deadline
+			pending = append(pending, source)
+			if expired {
+				tm.haltRollout(template, status, fmt.Sprintf("source %s failed: %s", key, state.Message))
+			}
+		default:
+			pending = append(pending, source)
+			if expired {
+				tm.haltRollout(template, status, fmt.Sprintf("source %s was not ready within %s: %s", key, deadline, state.Reason))
+			}
+		}
+	}
+	status.Updated = len(updated)
+
+	if status.Phase == templatev1.RolloutHalted {
+		tm.allowSources(updated, false)
+		return updated, ctrl.Result{}, nil
+	}
+	if len(pending) > 0 {
+		tm.allowSources(updated, false)
+		return pending, ctrl.Result{RequeueAfter: rolloutCheckInterval}, nil
+	}
+	if spec.Pause != nil && status.LastBatchTime != nil {
+		if wait := spec.Pause.Duration - time.Since(status.LastBatchTime.Time); wait > 0 {
+			tm.allowSources(updated, false)
+			return nil, ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+
+	batch, err := nextBatch(spec, status.Batches, keysOf(updated), sources)
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	if len(batch) == 0 {
+		status.Phase = templatev1.RolloutCompleted
+		status.Message = fmt.Sprintf("Rolled out to %d sources in %d batches", len(sources), status.Batches)
+		tm.Events.Eventf(template, v1.EventTypeNormal, "RolloutCompleted", "Rollout of generation %d completed", status.Generation)
+		tm.allowSources(nil, true)
+		return sources, ctrl.Result{}, nil
+	}
+
+	now := metav1.Now()
+	status.Batches++
+	status.LastBatchTime = &now
+	updated = append(updated, batch...)
+	status.Updated = len(updated)
+	status.Message = fmt.Sprintf("Batch %d, updated %d of %d sources", status.Batches, len(updated), len(sources))
+	tm.Events.Eventf(template, v1.EventTypeNormal, "RolloutBatch", "Rollout of generation %d started batch %d with %d sources", status.Generation, status.Batches, len(batch))
+	tm.allowSources(updated, false)
+	return batch, ctrl.Result{RequeueAfter: rolloutCheckInterval}, nil
+}
+
+// haltRollout halts the rollout with message, unless it is halted already
+func (tm *TemplateManager) haltRollout(template *templatev1.Template, status *templatev1.TemplateRolloutStatus, message string) {
+	if status.Phase == templatev1.RolloutHalted {
+		return
+	}
+	status.Phase = templatev1.RolloutHalted
+	status.Message = message
+	tm.Events.Eventf(template, v1.EventTypeWarning, "RolloutHalted", "Rollout of generation %d halted, %s", status.Generation, message)
+}
+
+// rolloutSources returns the sources of the first batches of a rollout, and the
+// sources for which handled returns true
+func rolloutSources(spec *templatev1.TemplateRollout, batches int, sources []unstructured.Unstructured, handled func(source string) bool) ([]unstructured.Unstructured, error) {
+	// the batches are replayed before adding the handled sources, which would
+	// otherwise shift the sources of the batches
+	done := map[string]bool{}
+	for i := 0; i < batches; i++ {
+		batch, err := nextBatch(spec, i, done, sources)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range batch {
+			done[sourceKeyOf(source)] = true
+		}
+	}
+	for _, source := range sources {
+		if key := sourceKeyOf(source); handled(key) {
+			done[key] = true
+		}
+	}
+
+	var updated []unstructured.Unstructured
+	for _, source := range sources {
+		if done[sourceKeyOf(source)] {
+			updated = append(updated, source)
+		}
+	}
+	sortSources(updated)
+	return updated, nil
+}
+
+// nextBatch returns the sources not done of the batch with index batch of a rollout:
+// the canary sources first, then the remaining sources in a stable order, BatchSize at
+// a time
+func nextBatch(spec *templatev1.TemplateRollout, batch int, done map[string]bool, sources []unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+	var canary labels.Selector
+	if spec.CanarySelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(spec.CanarySelector)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid canary selector")
+		}
+		canary = selector
+	}
+
+	var canaries, remaining []unstructured.Unstructured
+	for _, source := range sources {
+		if done[sourceKeyOf(source)] {
+			continue
+		}
+		if canary != nil && canary.Matches(labels.Set(source.GetLabels())) {
+			canaries = append(canaries, source)
+		} else {
+			remaining = append(remaining, source)
+		}
+	}
+	sortSources(canaries)
+	if batch == 0 && len(canaries) > 0 {
+		return canaries, nil
+	}
+	remaining = append(canaries, remaining...)
+	sortSources(remaining)
+
+	size := len(sources)
+	if spec.BatchSize != nil {
+		scaled, err := intstr.GetScaledValueFromIntOrPercent(spec.BatchSize, len(sources), true)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid batch size")
+		}
+		size = scaled
+	}
+	if size < 1 {
+		size = 1
+	}
+	if size > len(remaining) {
+		size = len(remaining)
+	}
+	return remaining[:size], nil
+}
+
+func sortSources(sources []unstructured.Unstructured) {
+	sort.Slice(sources, func(i, j int) bool {
+		return sourceKeyOf(sources[i]) < sourceKeyOf(sources[j])
+	})
+}
+
+func sourceKeyOf(source unstructured.Unstructured) string {
+	return SourceKey(source.GetKind(), source.GetNamespace(), source.GetName())
+}
+
+func keysOf(sources []unstructured.Unstructured) map[string]bool {
+	keys := map[string]bool{}
+	for _, source := range sources {
+		keys[sourceKeyOf(source)] = true
+	}
+	return keys
+}
+
+// allowSources sets the sources allowed by the rollout, all of them if all is set
+func (tm *TemplateManager) allowSources(sources []unstructured.Unstructured, all bool) {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	tm.rolloutComputed = true
+	tm.rolloutAll = all
+	tm.rolloutSources = keysOf(sources)
+}
+
+// RolloutAllows returns whether source may be reconciled with the current generation
+// of template, i.e. it is not waiting for a later batch of a rollout. No source is
+// allowed until Run computed the rollout
+func (tm *TemplateManager) RolloutAllows(template *templatev1.Template, source string) bool {
+	if template.Spec.Rollout == nil {
+		return true
+	}
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	return tm.rolloutComputed && (tm.rolloutAll || tm.rolloutSources[source])
+}
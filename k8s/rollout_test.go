@@ -0,0 +1,227 @@
+package k8s_test
+
+import (
+	"fmt"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("Rollout", func() {
+	newSource := func(name string, labels map[string]interface{}) unstructured.Unstructured {
+		metadata := map[string]interface{}{"name": name, "namespace": "default"}
+		if labels != nil {
+			metadata["labels"] = labels
+		}
+		return unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   metadata,
+		}}
+	}
+	newSources := func(n int) []unstructured.Unstructured {
+		var sources []unstructured.Unstructured
+		for i := 0; i < n; i++ {
+			sources = append(sources, newSource(fmt.Sprintf("source-%d", i), nil))
+		}
+		return sources
+	}
+	names := func(sources []unstructured.Unstructured) []string {
+		var names []string
+		for _, source := range sources {
+			names = append(names, source.GetName())
+		}
+		return names
+	}
+	key := func(name string) string {
+		return k8s.SourceKey("ConfigMap", "default", name)
+	}
+
+	Describe("nextBatch", func() {
+		It("Starts with the canary sources", func() {
+			sources := append(newSources(3), newSource("canary", map[string]interface{}{"canary": "true"}))
+			batchSize := intstr.FromInt(2)
+			spec := &templatev1.TemplateRollout{
+				CanarySelector: &metav1.LabelSelector{MatchLabels: map[string]string{"canary": "true"}},
+				BatchSize:      &batchSize,
+			}
+
+			batch, err := k8s.NextBatch(spec, 0, map[string]bool{}, sources)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(batch)).To(Equal([]string{"canary"}))
+
+			batch, err = k8s.NextBatch(spec, 1, map[string]bool{key("canary"): true}, sources)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(batch)).To(Equal([]string{"source-0", "source-1"}))
+		})
+
+		It("Scales percentages to the number of sources", func() {
+			batchSize := intstr.FromString("25%")
+			spec := &templatev1.TemplateRollout{BatchSize: &batchSize}
+			batch, err := k8s.NextBatch(spec, 0, map[string]bool{key("source-0"): true}, newSources(10))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(batch)).To(Equal([]string{"source-1", "source-2", "source-3"}))
+		})
+
+		It("Updates all sources without a batch size", func() {
+			batch, err := k8s.NextBatch(&templatev1.TemplateRollout{}, 0, map[string]bool{}, newSources(3))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(batch).To(HaveLen(3))
+		})
+
+		It("Returns no batch once all sources are done", func() {
+			batch, err := k8s.NextBatch(&templatev1.TemplateRollout{}, 1, map[string]bool{key("source-0"): true}, newSources(1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(batch).To(BeEmpty())
+		})
+	})
+
+	Describe("rollout", func() {
+		var tm *k8s.TemplateManager
+		var template *templatev1.Template
+
+		BeforeEach(func() {
+			tm = &k8s.TemplateManager{States: k8s.NewSourceStates(), Events: record.NewFakeRecorder(10)}
+			batchSize := intstr.FromInt(2)
+			template = &templatev1.Template{
+				ObjectMeta: metav1.ObjectMeta{Name: "configmaps", Generation: 2},
+				Spec: templatev1.TemplateSpec{
+					Rollout: &templatev1.TemplateRollout{BatchSize: &batchSize},
+				},
+			}
+		})
+
+		handled := func(name, reason string) {
+			tm.States.Set(key(name), k8s.SourceState{Generation: template.Generation, Reason: reason, Message: "message"})
+		}
+
+		It("Starts the first batch", func() {
+			updated, result, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(updated)).To(Equal([]string{"source-0", "source-1"}))
+			Expect(result.RequeueAfter).ToNot(BeZero())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutProgressing))
+			Expect(template.Status.Rollout.Batches).To(Equal(1))
+			Expect(tm.RolloutAllows(template, key("source-1"))).To(BeTrue())
+			Expect(tm.RolloutAllows(template, key("source-2"))).To(BeFalse())
+		})
+
+		It("Waits for the sources of the batch to be ready", func() {
+			_, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			handled("source-0", k8s.SourceReasonReady)
+			handled("source-1", k8s.SourceReasonNotReady)
+
+			// only the sources of the batch that are not ready are checked again
+			pending, result, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(pending)).To(Equal([]string{"source-1"}))
+			Expect(result.RequeueAfter).ToNot(BeZero())
+			Expect(template.Status.Rollout.Batches).To(Equal(1))
+			Expect(template.Status.Rollout.Updated).To(Equal(2))
+			Expect(template.Status.Rollout.Ready).To(Equal(1))
+			Expect(tm.RolloutAllows(template, key("source-0"))).To(BeTrue())
+
+			handled("source-1", k8s.SourceReasonReady)
+			batch, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(batch)).To(Equal([]string{"source-2", "source-3"}))
+			Expect(template.Status.Rollout.Batches).To(Equal(2))
+			Expect(template.Status.Rollout.Updated).To(Equal(4))
+			Expect(tm.RolloutAllows(template, key("source-0"))).To(BeTrue())
+			Expect(tm.RolloutAllows(template, key("source-3"))).To(BeTrue())
+		})
+
+		It("Lets a failed source recover before the progress deadline", func() {
+			_, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			handled("source-0", k8s.SourceReasonReady)
+			handled("source-1", k8s.SourceReasonFailed)
+
+			pending, result, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(pending)).To(Equal([]string{"source-1"}))
+			Expect(result.RequeueAfter).ToNot(BeZero())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutProgressing))
+
+			handled("source-1", k8s.SourceReasonReady)
+			batch, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names(batch)).To(Equal([]string{"source-2", "source-3"}))
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutProgressing))
+		})
+
+		It("Halts when a source is still failed after the progress deadline", func() {
+			_, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			handled("source-0", k8s.SourceReasonReady)
+			handled("source-1", k8s.SourceReasonFailed)
+
+			started := metav1.NewTime(time.Now().Add(-11 * time.Minute))
+			template.Status.Rollout.LastBatchTime = &started
+			updated, result, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(updated).To(HaveLen(2))
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutHalted))
+			Expect(template.Status.Rollout.Message).To(ContainSubstring(key("source-1") + " failed"))
+			Expect(tm.RolloutAllows(template, key("source-2"))).To(BeFalse())
+		})
+
+		It("Halts when a source is not ready within the progress deadline", func() {
+			template.Spec.Rollout.ProgressDeadline = &metav1.Duration{Duration: time.Minute}
+			_, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			handled("source-0", k8s.SourceReasonReady)
+			handled("source-1", k8s.SourceReasonNotReady)
+
+			_, _, err = tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutProgressing))
+
+			started := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+			template.Status.Rollout.LastBatchTime = &started
+			_, _, err = tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutHalted))
+			Expect(template.Status.Rollout.Message).To(ContainSubstring("not ready within 1m0s"))
+		})
+
+		It("Halts when a source is not updated within the progress deadline", func() {
+			_, _, err := tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			handled("source-0", k8s.SourceReasonReady)
+
+			started := metav1.NewTime(time.Now().Add(-11 * time.Minute))
+			template.Status.Rollout.LastBatchTime = &started
+			_, _, err = tm.Rollout(template, newSources(5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutHalted))
+			Expect(template.Status.Rollout.Message).To(ContainSubstring("source-1 was not updated"))
+		})
+
+		It("Completes once all batches are ready", func() {
+			sources := newSources(3)
+			for i := 0; i < 2; i++ {
+				_, _, err := tm.Rollout(template, sources)
+				Expect(err).ToNot(HaveOccurred())
+				for _, source := range sources {
+					handled(source.GetName(), k8s.SourceReasonReady)
+				}
+			}
+			updated, result, err := tm.Rollout(template, sources)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(updated).To(HaveLen(3))
+			Expect(result.RequeueAfter).To(BeZero())
+			Expect(template.Status.Rollout.Phase).To(Equal(templatev1.RolloutCompleted))
+			Expect(tm.RolloutAllows(template, key("source-2"))).To(BeTrue())
+		})
+	})
+})
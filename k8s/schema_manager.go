@@ -12,6 +12,8 @@ import (
 	"github.com/go-openapi/jsonpointer"
 	"github.com/go-openapi/spec"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	extapi "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/typed/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -99,7 +101,10 @@ func NewSchemaManager(clientset *kubernetes.Clientset, crdClient extapi.Apiexten
 	return mgr, nil
 }
 
-func (m *SchemaManager) DuckType(gvk schema.GroupVersionKind, object *unstructured.Unstructured) error {
+func (m *SchemaManager) DuckType(ctx context.Context, gvk schema.GroupVersionKind, object *unstructured.Unstructured) (err error) {
+	_, span := tracer.Start(ctx, "SchemaManager.DuckType", trace.WithAttributes(attribute.String("gvk", gvk.String())))
+	defer func() { endSpan(span, err) }()
+
 	schema, found, err := m.FindSchemaForKind(gvk)
 	if err != nil {
 		return errors.Wrapf(err, "error finding kind %v", gvk)
@@ -281,6 +286,36 @@ func (m *SchemaManager) FindTypeForKeyFromSchema(schema *spec.Schema, key string
 	return typedField, nil
 }
 
+// HasField returns whether key, e.g. status.phase, is a field of the schema of gvk.
+// Any field of an object preserving unknown fields exists
+func (m *SchemaManager) HasField(gvk schema.GroupVersionKind, key string) (bool, error) {
+	parent, found, err := m.FindSchemaForKind(gvk)
+	if err != nil {
+		return false, errors.Wrapf(err, "error finding kind %v", gvk)
+	}
+	if !found {
+		return false, errors.Errorf("kind %v does not exist", gvk)
+	}
+
+	for _, part := range strings.Split(key, ".") {
+		if preserve, _ := parent.Extensions.GetBool("x-kubernetes-preserve-unknown-fields"); preserve {
+			return true, nil
+		}
+		if !parent.Type.Contains("object") && len(parent.Properties) == 0 {
+			return false, nil
+		}
+		field, err := m.findTypeForKey(parent, part)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to find type for key %s", key)
+		}
+		if field == nil {
+			return false, nil
+		}
+		parent = field
+	}
+	return true, nil
+}
+
 func (m *SchemaManager) findTypeForKey(schema *spec.Schema, key string) (*spec.Schema, error) {
 	parts := strings.SplitN(key, ".", 2)
 	fieldName := parts[0]
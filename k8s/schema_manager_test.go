@@ -1,6 +1,7 @@
 package k8s_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -399,7 +400,7 @@ func duckTypeWithValue(template string) (*unstructured.Unstructured, error) {
 	groupVersionKind := schema.GroupVersionKind{Group: apiGroup, Version: apiVersion, Kind: resource.GetKind()}
 
 	mgr := newSchemaManager()
-	err := mgr.DuckType(groupVersionKind, resource)
+	err := mgr.DuckType(context.TODO(), groupVersionKind, resource)
 	return resource, err
 }
 
@@ -0,0 +1,246 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SourceReasonFailed is the reason of the state of a source which failed to be handled
+const SourceReasonFailed = "Failed"
+
+// BlockedResource is a generated resource that is not applied as some of its
+// dependencies are not ready
+type BlockedResource struct {
+	// Source is the kind/namespace/name of the source the resource is generated for
+	Source    string
+	ID        string
+	Kind      string
+	Namespace string
+	Name      string
+	// WaitingFor lists the ids of the dependencies that are not ready
+	WaitingFor []string
+	// Since is the time the resource started waiting
+	Since metav1.Time
+	// TimedOut is set once a dependency was not ready within its timeout
+	TimedOut bool
+}
+
+// ResourceConflict is a generated object, or fields of a source, owned by another
+// template with the same or a higher priority
+type ResourceConflict struct {
+	// Source is the kind/namespace/name of the source the object is generated for
+	Source    string
+	Kind      string
+	Namespace string
+	Name      string
+	// Fields lists the patched fields of the source owned by Owner, empty if the
+	// whole object is
+	Fields []string
+	// Owner is the template owning the object or fields
+	Owner string
+}
+
+// SourceState is the outcome of the last HandleSource of a source
+type SourceState struct {
+	// Generation of the template handled
+	Generation int64
+	// Revision last applied to the source, kept when handling the source fails
+	Revision string
+	// Reason is one of the SourceReason constants
+	Reason  string
+	Message string
+	// Blocked lists the generated resources waiting for their dependencies
+	Blocked []BlockedResource
+	// Conflicts lists the generated objects and source fields owned by other templates
+	Conflicts []ResourceConflict
+}
+
+// SourceStates holds the state of the sources of a template in memory, the template
+// status only counts them as it would exceed the size limit of objects with thousands
+// of sources. States are rebuilt as sources are handled after the operator restarts.
+// It is safe for concurrent use
+type SourceStates struct {
+	mtx    sync.Mutex
+	states map[string]SourceState
+}
+
+func NewSourceStates() *SourceStates {
+	return &SourceStates{states: map[string]SourceState{}}
+}
+
+// Get returns the state of source, false if it was not handled yet
+func (s *SourceStates) Get(source string) (SourceState, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	state, found := s.states[source]
+	return state, found
+}
+
+func (s *SourceStates) Set(source string, state SourceState) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.states[source] = state
+}
+
+// Delete removes source, once it is deleted
+func (s *SourceStates) Delete(source string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.states, source)
+}
+
+// Retain removes the sources not in sources, once they are no longer selected
+func (s *SourceStates) Retain(sources map[string]bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for source := range s.states {
+		if !sources[source] {
+			delete(s.states, source)
+		}
+	}
+}
+
+// Blocked returns the blocked resources of the sources ordered by source, at most limit
+// of them
+func (s *SourceStates) Blocked(limit int) []templatev1.BlockedResource {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var blocked []templatev1.BlockedResource
+	for _, source := range s.sortedSources() {
+		for _, b := range s.states[source].Blocked {
+			if len(blocked) == limit {
+				return blocked
+			}
+			blocked = append(blocked, templatev1.BlockedResource{
+				Source:     b.Source,
+				ID:         b.ID,
+				Kind:       b.Kind,
+				Namespace:  b.Namespace,
+				Name:       b.Name,
+				WaitingFor: append([]string{}, b.WaitingFor...),
+				// the precision of the time written to the status, so that unchanged
+				// entries do not update it
+				Since:    b.Since.Rfc3339Copy(),
+				TimedOut: b.TimedOut,
+			})
+		}
+	}
+	return blocked
+}
+
+// RestoreBlocked records the blocked resources listed in the status of a template for
+// sources that were not handled yet, so that dependency timeouts are measured from the
+// time resources started waiting after the operator restarts
+func (s *SourceStates) RestoreBlocked(blocked []templatev1.BlockedResource) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	restored := map[string]bool{}
+	for _, b := range blocked {
+		state, found := s.states[b.Source]
+		if found && !restored[b.Source] {
+			continue
+		}
+		restored[b.Source] = true
+		state.Reason = SourceReasonBlocked
+		state.Blocked = append(state.Blocked, BlockedResource{
+			Source:     b.Source,
+			ID:         b.ID,
+			Kind:       b.Kind,
+			Namespace:  b.Namespace,
+			Name:       b.Name,
+			WaitingFor: append([]string{}, b.WaitingFor...),
+			Since:      b.Since,
+			TimedOut:   b.TimedOut,
+		})
+		s.states[b.Source] = state
+	}
+}
+
+// Revisions returns the sources revision is not applied to, with the revision they are
+// on, ordered by source. At most limit sources are returned
+func (s *SourceStates) Revisions(revision string, limit int) []templatev1.SourceRevision {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var revisions []templatev1.SourceRevision
+	for _, source := range s.sortedSources() {
+		if state := s.states[source]; state.Revision != revision {
+			if len(revisions) == limit {
+				break
+			}
+			revisions = append(revisions, templatev1.SourceRevision{Source: source, Revision: state.Revision})
+		}
+	}
+	return revisions
+}
+
+// RestoreRevisions records the revisions listed in the status of a template for
+// sources that were not handled yet
+func (s *SourceStates) RestoreRevisions(revisions []templatev1.SourceRevision) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, r := range revisions {
+		state := s.states[r.Source]
+		if state.Revision == "" {
+			state.Revision = r.Revision
+			s.states[r.Source] = state
+		}
+	}
+}
+
+func (s *SourceStates) sortedSources() []string {
+	sources := make([]string, 0, len(s.states))
+	for source := range s.states {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Summary counts the sources by state, sources are updated once revision was applied.
+// Sources with conflicts are also counted by their state
+func (s *SourceStates) Summary(revision string) templatev1.TemplateSummary {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	summary := templatev1.TemplateSummary{Sources: len(s.states)}
+	for _, state := range s.states {
+		if revision != "" && state.Revision == revision {
+			summary.Updated++
+		}
+		if len(state.Conflicts) > 0 {
+			summary.Conflicts++
+		}
+		switch state.Reason {
+		case SourceReasonReady:
+			summary.Ready++
+		case SourceReasonBlocked:
+			summary.Blocked++
+		case SourceReasonFailed:
+			summary.Failed++
+		default:
+			summary.NotReady++
+		}
+	}
+	return summary
+}
+
+// ConflictCondition returns the Conflict condition of a template with generation for
+// the summary of its sources
+func ConflictCondition(generation int64, summary templatev1.TemplateSummary) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               templatev1.TemplateConditionConflict,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
+		Reason:             "NoConflicts",
+		Message:            "All generated objects are owned by the template",
+	}
+	if summary.Conflicts > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "OwnedByOtherTemplates"
+		condition.Message = fmt.Sprintf("Objects generated for %d sources are owned by other templates", summary.Conflicts)
+	}
+	return condition
+}
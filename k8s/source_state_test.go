@@ -0,0 +1,124 @@
+package k8s_test
+
+import (
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("SourceStates", func() {
+	It("Counts sources by state", func() {
+		states := k8s.NewSourceStates()
+		states.Set("ConfigMap/default/a", k8s.SourceState{Revision: "new", Reason: k8s.SourceReasonReady})
+		states.Set("ConfigMap/default/b", k8s.SourceState{Revision: "old", Reason: k8s.SourceReasonNotReady})
+		states.Set("ConfigMap/default/c", k8s.SourceState{Revision: "new", Reason: k8s.SourceReasonBlocked})
+		states.Set("ConfigMap/default/d", k8s.SourceState{Reason: k8s.SourceReasonFailed})
+		states.Set("ConfigMap/default/e", k8s.SourceState{
+			Revision:  "new",
+			Reason:    k8s.SourceReasonConflict,
+			Conflicts: []k8s.ResourceConflict{{Kind: "Secret", Name: "e", Owner: "other"}},
+		})
+
+		Expect(states.Summary("new")).To(Equal(templatev1.TemplateSummary{
+			Sources:   5,
+			Updated:   3,
+			Ready:     1,
+			NotReady:  2,
+			Blocked:   1,
+			Conflicts: 1,
+			Failed:    1,
+		}))
+	})
+
+	It("Removes sources no longer selected", func() {
+		states := k8s.NewSourceStates()
+		states.Set("ConfigMap/default/a", k8s.SourceState{Reason: k8s.SourceReasonReady})
+		states.Set("ConfigMap/default/b", k8s.SourceState{Reason: k8s.SourceReasonReady})
+
+		states.Retain(map[string]bool{"ConfigMap/default/b": true})
+		_, found := states.Get("ConfigMap/default/a")
+		Expect(found).To(BeFalse())
+		Expect(states.Summary("").Sources).To(Equal(1))
+	})
+
+	It("Lists the blocked resources ordered by source", func() {
+		since := metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 500, time.UTC))
+		states := k8s.NewSourceStates()
+		states.Set("ConfigMap/default/b", k8s.SourceState{Reason: k8s.SourceReasonBlocked, Blocked: []k8s.BlockedResource{
+			{Source: "ConfigMap/default/b", ID: "app", WaitingFor: []string{"db"}, Since: since},
+			{Source: "ConfigMap/default/b", ID: "web", WaitingFor: []string{"app"}, Since: since, TimedOut: true},
+		}})
+		states.Set("ConfigMap/default/a", k8s.SourceState{Reason: k8s.SourceReasonBlocked, Blocked: []k8s.BlockedResource{
+			{Source: "ConfigMap/default/a", ID: "app", Kind: "Deployment", WaitingFor: []string{"db"}, Since: since},
+		}})
+		states.Set("ConfigMap/default/c", k8s.SourceState{Reason: k8s.SourceReasonReady})
+
+		blocked := states.Blocked(templatev1.MaxStatusEntries)
+		Expect(blocked).To(HaveLen(3))
+		Expect(blocked[0].Source).To(Equal("ConfigMap/default/a"))
+		Expect(blocked[0].Kind).To(Equal("Deployment"))
+		Expect(blocked[0].WaitingFor).To(Equal([]string{"db"}))
+		// the status only has a precision of seconds
+		Expect(blocked[0].Since.Time).To(BeTemporally("==", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(blocked[2].ID).To(Equal("web"))
+		Expect(blocked[2].TimedOut).To(BeTrue())
+
+		Expect(states.Blocked(2)).To(HaveLen(2))
+	})
+
+	It("Restores blocked resources of sources not handled yet", func() {
+		since := metav1.NewTime(time.Now().Add(-time.Hour))
+		states := k8s.NewSourceStates()
+		states.Set("ConfigMap/default/b", k8s.SourceState{Reason: k8s.SourceReasonReady})
+
+		states.RestoreBlocked([]templatev1.BlockedResource{
+			{Source: "ConfigMap/default/a", ID: "app", WaitingFor: []string{"db"}, Since: since},
+			{Source: "ConfigMap/default/a", ID: "web", WaitingFor: []string{"app"}, Since: since},
+			{Source: "ConfigMap/default/b", ID: "app", WaitingFor: []string{"db"}, Since: since},
+		})
+		state, found := states.Get("ConfigMap/default/a")
+		Expect(found).To(BeTrue())
+		Expect(state.Reason).To(Equal(k8s.SourceReasonBlocked))
+		Expect(state.Blocked).To(HaveLen(2))
+		Expect(state.Blocked[0].Since).To(Equal(since))
+
+		state, _ = states.Get("ConfigMap/default/b")
+		Expect(state.Reason).To(Equal(k8s.SourceReasonReady))
+		Expect(state.Blocked).To(BeEmpty())
+	})
+
+	It("Lists the sources on other revisions", func() {
+		states := k8s.NewSourceStates()
+		states.Set("ConfigMap/default/a", k8s.SourceState{Revision: "new"})
+		states.Set("ConfigMap/default/d", k8s.SourceState{Revision: "old"})
+		states.Set("ConfigMap/default/c", k8s.SourceState{})
+		states.Set("ConfigMap/default/b", k8s.SourceState{Revision: "old"})
+
+		Expect(states.Revisions("new", templatev1.MaxStatusEntries)).To(Equal([]templatev1.SourceRevision{
+			{Source: "ConfigMap/default/b", Revision: "old"},
+			{Source: "ConfigMap/default/c"},
+			{Source: "ConfigMap/default/d", Revision: "old"},
+		}))
+		Expect(states.Revisions("new", 1)).To(HaveLen(1))
+		Expect(states.Revisions("old", templatev1.MaxStatusEntries)).To(HaveLen(2))
+	})
+
+	It("Restores the revisions of sources not handled yet", func() {
+		states := k8s.NewSourceStates()
+		states.Set("ConfigMap/default/b", k8s.SourceState{Revision: "new"})
+		states.RestoreRevisions([]templatev1.SourceRevision{
+			{Source: "ConfigMap/default/a", Revision: "old"},
+			{Source: "ConfigMap/default/b", Revision: "old"},
+		})
+
+		state, found := states.Get("ConfigMap/default/a")
+		Expect(found).To(BeTrue())
+		Expect(state.Revision).To(Equal("old"))
+		state, _ = states.Get("ConfigMap/default/b")
+		Expect(state.Revision).To(Equal("new"))
+	})
+})
@@ -0,0 +1,138 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// Reasons of the status written onto sources
+const (
+	SourceReasonReady    = "Ready"
+	SourceReasonNotReady = "NotReady"
+	SourceReasonBlocked  = "DependenciesNotReady"
+	SourceReasonConflict = "Conflict"
+)
+
+// SourceStatusAnnotation is the prefix of the annotation holding the status of a
+// template on its sources, followed by the template name
+const SourceStatusAnnotation = "templating.flanksource.com/status-"
+
+// setSourceStatus writes the readiness of the resources generated for source as
+// configured by the sourceStatus of template, nothing is written by default or if it
+// is unchanged. Conditions are patched with the resourceVersion they were read at, so
+// that conditions written concurrently by the controller of the source are kept
+func (tm *TemplateManager) setSourceStatus(ctx context.Context, template *templatev1.Template, source unstructured.Unstructured, reason, message string) error {
+	switch template.Spec.SourceStatus {
+	case templatev1.SourceStatusAnnotation:
+		annotation := SourceStatusAnnotation + template.Name
+		if source.GetAnnotations()[annotation] == reason {
+			return nil
+		}
+		patch := map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]interface{}{annotation: reason}}}
+		return tm.patchSource(ctx, template, source, reason, patch)
+	case templatev1.SourceStatusCondition:
+		conditionType := fmt.Sprintf("template-%s", template.Name)
+		if _, changed, err := setSourceCondition(source, conditionType, reason, message); err != nil || !changed {
+			return err
+		}
+		client, err := ResourceClient(tm.Client, source.GetAPIVersion(), source.GetKind())
+		if err != nil {
+			return errors.Wrapf(err, "failed to get dynamic client for kind %s", source.GetKind())
+		}
+		latest := &source
+		return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			conditions, changed, err := setSourceCondition(*latest, conditionType, reason, message)
+			if err != nil || !changed {
+				return err
+			}
+			patch := map[string]interface{}{
+				"metadata": map[string]interface{}{"resourceVersion": latest.GetResourceVersion()},
+				"status":   map[string]interface{}{"conditions": conditions},
+			}
+			err = tm.patchSource(ctx, template, source, reason, patch, "status")
+			if kerrors.IsConflict(err) {
+				// the source changed since it was read, retry on the latest conditions
+				refreshed, getErr := client.Namespace(source.GetNamespace()).Get(ctx, source.GetName(), metav1.GetOptions{})
+				if getErr != nil {
+					return errors.Wrapf(getErr, "failed to get %s %s", source.GetKind(), source.GetName())
+				}
+				latest = refreshed
+			}
+			return err
+		})
+	default:
+		return nil
+	}
+}
+
+// patchSource merge patches source, or its subresources
+func (tm *TemplateManager) patchSource(ctx context.Context, template *templatev1.Template, source unstructured.Unstructured, reason string, patch map[string]interface{}, subresources ...string) error {
+	tm.Log.V(2).Info("setting status on source", "template", template.Name, "reason", reason, "kind", source.GetKind(), "namespace", source.GetNamespace(), "name", source.GetName())
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal status patch")
+	}
+	client, err := ResourceClient(tm.Client, source.GetAPIVersion(), source.GetKind())
+	if err != nil {
+		return errors.Wrapf(err, "failed to get dynamic client for kind %s", source.GetKind())
+	}
+	resource := client.Namespace(source.GetNamespace())
+	_, err = resource.Patch(ctx, source.GetName(), types.MergePatchType, data, metav1.PatchOptions{}, subresources...)
+	if kerrors.IsNotFound(err) && len(subresources) > 0 {
+		// the resource does not have a status subresource
+		_, err = resource.Patch(ctx, source.GetName(), types.MergePatchType, data, metav1.PatchOptions{})
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch status of %s %s", source.GetKind(), source.GetName())
+	}
+	return nil
+}
+
+// setSourceCondition returns the status conditions of source with the condition
+// conditionType set from reason and message, and whether it changed. The last
+// transition time is only updated when the condition status changes
+func setSourceCondition(source unstructured.Unstructured, conditionType, reason, message string) ([]interface{}, bool, error) {
+	conditions, _, err := unstructured.NestedSlice(source.Object, "status", "conditions")
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to get status conditions")
+	}
+
+	status := metav1.ConditionFalse
+	if reason == SourceReasonReady {
+		status = metav1.ConditionTrue
+	}
+	condition := map[string]interface{}{
+		"type":               conditionType,
+		"status":             string(status),
+		"reason":             reason,
+		"message":            message,
+		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	for i, c := range conditions {
+		existing, ok := c.(map[string]interface{})
+		if !ok || existing["type"] != conditionType {
+			continue
+		}
+		unchanged := existing["status"] == condition["status"]
+		if unchanged && existing["reason"] == reason && (existing["message"] == message || existing["message"] == nil && message == "") {
+			return conditions, false, nil
+		}
+		if unchanged && existing["lastTransitionTime"] != nil {
+			condition["lastTransitionTime"] = existing["lastTransitionTime"]
+		}
+		conditions[i] = condition
+		return conditions, true, nil
+	}
+	return append(conditions, condition), true, nil
+}
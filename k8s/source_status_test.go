@@ -0,0 +1,87 @@
+package k8s_test
+
+import (
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("SourceStatus", func() {
+	source := func(conditions ...interface{}) unstructured.Unstructured {
+		obj := unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1",
+			"kind":       "Database",
+			"metadata":   map[string]interface{}{"name": "db", "namespace": "default", "resourceVersion": "1"},
+		}}
+		if len(conditions) > 0 {
+			obj.Object["status"] = map[string]interface{}{"conditions": conditions}
+		}
+		return obj
+	}
+	readyCondition := map[string]interface{}{
+		"type":               "Ready",
+		"status":             "True",
+		"reason":             "Provisioned",
+		"lastTransitionTime": "2023-01-01T00:00:00Z",
+	}
+
+	It("Does not write onto sources by default", func() {
+		// a nil client would panic if the source was patched
+		tm := &k8s.TemplateManager{}
+		template := &templatev1.Template{ObjectMeta: metav1.ObjectMeta{Name: "databases"}}
+		Expect(tm.SetSourceStatus(template, source(), k8s.SourceReasonNotReady, "")).To(Succeed())
+
+		template.Spec.SourceStatus = templatev1.SourceStatusNone
+		Expect(tm.SetSourceStatus(template, source(), k8s.SourceReasonNotReady, "")).To(Succeed())
+	})
+
+	It("Does not patch an unchanged condition", func() {
+		tm := &k8s.TemplateManager{}
+		template := &templatev1.Template{ObjectMeta: metav1.ObjectMeta{Name: "databases"}}
+		template.Spec.SourceStatus = templatev1.SourceStatusCondition
+		existing := map[string]interface{}{
+			"type":               "template-databases",
+			"status":             "True",
+			"reason":             k8s.SourceReasonReady,
+			"message":            "",
+			"lastTransitionTime": "2023-01-01T00:00:00Z",
+		}
+		Expect(tm.SetSourceStatus(template, source(readyCondition, existing), k8s.SourceReasonReady, "")).To(Succeed())
+	})
+
+	It("Adds the condition and keeps the conditions of other controllers", func() {
+		conditions, changed, err := k8s.SetSourceCondition(source(readyCondition), "template-databases", k8s.SourceReasonNotReady, "waiting")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(conditions).To(HaveLen(2))
+		Expect(conditions[0]).To(Equal(readyCondition))
+		condition := conditions[1].(map[string]interface{})
+		Expect(condition["type"]).To(Equal("template-databases"))
+		Expect(condition["status"]).To(Equal("False"))
+		Expect(condition["reason"]).To(Equal(k8s.SourceReasonNotReady))
+		Expect(condition["message"]).To(Equal("waiting"))
+	})
+
+	It("Keeps the transition time while the status is unchanged", func() {
+		existing := map[string]interface{}{
+			"type":               "template-databases",
+			"status":             "False",
+			"reason":             k8s.SourceReasonNotReady,
+			"lastTransitionTime": "2023-01-01T00:00:00Z",
+		}
+		conditions, changed, err := k8s.SetSourceCondition(source(existing), "template-databases", k8s.SourceReasonBlocked, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(conditions).To(HaveLen(1))
+		condition := conditions[0].(map[string]interface{})
+		Expect(condition["reason"]).To(Equal(k8s.SourceReasonBlocked))
+		Expect(condition["lastTransitionTime"]).To(Equal("2023-01-01T00:00:00Z"))
+
+		conditions, _, err = k8s.SetSourceCondition(source(existing), "template-databases", k8s.SourceReasonReady, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conditions[0].(map[string]interface{})["lastTransitionTime"]).ToNot(Equal("2023-01-01T00:00:00Z"))
+	})
+})
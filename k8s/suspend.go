@@ -0,0 +1,30 @@
+package k8s
+
+import (
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SuspendedCondition returns the Suspended condition of template for spec.suspend, nil
+// if the status is up to date. The condition is only added once the template was suspended
+func SuspendedCondition(template *templatev1.Template) *metav1.Condition {
+	status, reason, message := metav1.ConditionFalse, "Resumed", "Template is reconciled"
+	if template.Spec.Suspend {
+		status, reason, message = metav1.ConditionTrue, "Suspended", "Template is suspended by spec.suspend"
+	}
+	condition := meta.FindStatusCondition(template.Status.Conditions, templatev1.TemplateConditionSuspended)
+	if condition == nil && !template.Spec.Suspend {
+		return nil
+	}
+	if condition != nil && condition.Status == status && condition.ObservedGeneration == template.Generation {
+		return nil
+	}
+	return &metav1.Condition{
+		Type:               templatev1.TemplateConditionSuspended,
+		Status:             status,
+		ObservedGeneration: template.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+}
@@ -0,0 +1,74 @@
+package k8s_test
+
+import (
+	"context"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("Suspend", func() {
+	template := func(suspend bool, conditions ...metav1.Condition) *templatev1.Template {
+		return &templatev1.Template{
+			ObjectMeta: metav1.ObjectMeta{Name: "databases", Generation: 2},
+			Spec:       templatev1.TemplateSpec{Suspend: suspend},
+			Status:     templatev1.TemplateStatus{Conditions: conditions},
+		}
+	}
+
+	It("Sets the Suspended condition once the template is suspended", func() {
+		Expect(k8s.SuspendedCondition(template(false))).To(BeNil())
+
+		condition := k8s.SuspendedCondition(template(true))
+		Expect(condition).ToNot(BeNil())
+		Expect(condition.Type).To(Equal(templatev1.TemplateConditionSuspended))
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.Reason).To(Equal("Suspended"))
+		Expect(condition.ObservedGeneration).To(Equal(int64(2)))
+	})
+
+	It("Resumes the Suspended condition", func() {
+		suspended := metav1.Condition{Type: templatev1.TemplateConditionSuspended, Status: metav1.ConditionTrue, ObservedGeneration: 1}
+		condition := k8s.SuspendedCondition(template(false, suspended))
+		Expect(condition).ToNot(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("Resumed"))
+	})
+
+	It("Does not update an up to date condition", func() {
+		suspended := metav1.Condition{Type: templatev1.TemplateConditionSuspended, Status: metav1.ConditionTrue, ObservedGeneration: 2}
+		Expect(k8s.SuspendedCondition(template(true, suspended))).To(BeNil())
+
+		// a new generation is observed even while the template stays suspended
+		suspended.ObservedGeneration = 1
+		Expect(k8s.SuspendedCondition(template(true, suspended))).ToNot(BeNil())
+	})
+
+	It("Skips the sources of a suspended template", func() {
+		// a template manager without a client or states would panic if it handled the source
+		tm := &k8s.TemplateManager{}
+		source := unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "db", "namespace": "default"},
+		}}
+		result, err := tm.HandleSource(context.Background(), template(true), source)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+
+		// suspended templates are not resynced either
+		tm.ResyncPeriod = time.Minute
+		result, err = tm.Run(context.Background(), template(true), func(unstructured.Unstructured) error {
+			Fail("suspended template listed its sources")
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(ctrl.Result{}))
+	})
+})
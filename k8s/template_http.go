@@ -0,0 +1,152 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var httpRequestAnnotation = "platform.flanksource.com/template-operator-http_%s"
+
+// idempotencyKeyHeader is set on requests so that the remote API can deduplicate a
+// request re-sent because writing its result back onto the source failed
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// handleHTTP sends the http request of the template rendered with target, unless the
+// same request was already sent for source, and writes the response back onto source.
+// If the rendered request changed since it was sent, http.update is sent instead
+func (tm *TemplateManager) handleHTTP(ctx context.Context, template *templatev1.Template, target, source unstructured.Unstructured) error {
+	spec := template.Spec.HTTP
+	data := target.Object
+	request, action, hash, err := tm.renderHTTPRequest(template, data, source)
+	if err != nil || request == nil {
+		return err
+	}
+	if err := tm.validateHTTPOutputs(source, action); err != nil {
+		return err
+	}
+	annotation := fmt.Sprintf(httpRequestAnnotation, template.Name)
+
+	resp, err := tm.RESTManager.doRequest(ctx, request)
+	if err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
+	response := resp.templateData()
+
+	annotations := map[string]string{annotation: hash}
+	for k, v := range spec.Annotations {
+		value, err := tm.RESTManager.templateResponse(resp.redactor, data, response, v)
+		if err != nil {
+			return errors.Wrapf(err, "failed to template annotation %s", k)
+		}
+		annotations[k] = resp.redactor.redact(value)
+	}
+	outputs, err := tm.RESTManager.templateOutputs(data, resp, action)
+	if err != nil {
+		return err
+	}
+
+	client, err := ResourceClient(tm.Client, source.GetAPIVersion(), source.GetKind())
+	if err != nil {
+		return errors.Wrapf(err, "failed to get dynamic client for kind %s", source.GetKind())
+	}
+	resource := client.Namespace(source.GetNamespace())
+
+	if len(outputs) > 0 {
+		patch, err := json.Marshal(map[string]interface{}{"status": outputs})
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal status patch")
+		}
+		_, err = resource.Patch(ctx, source.GetName(), types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+		if kerrors.IsNotFound(err) {
+			// the resource does not have a status subresource
+			_, err = resource.Patch(ctx, source.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to patch status of %s %s", source.GetKind(), source.GetName())
+		}
+	}
+
+	// the request hash is written last, so that the request is retried if any of the above fails
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal annotations patch")
+	}
+	if _, err := resource.Patch(ctx, source.GetName(), types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return errors.Wrapf(err, "failed to patch annotations of %s %s", source.GetKind(), source.GetName())
+	}
+
+	return nil
+}
+
+// renderHTTPRequest returns the request to send for source and the action it was
+// rendered from, either http or http.update if the request changed since it was sent
+// for source, along with the hash of the http request recorded on source once sent.
+// No request is returned if it was already sent
+func (tm *TemplateManager) renderHTTPRequest(template *templatev1.Template, data map[string]interface{}, source unstructured.Unstructured) (*restRequest, templatev1.RESTAction, string, error) {
+	spec := template.Spec.HTTP
+	rest := &templatev1.REST{
+		ObjectMeta: metav1.ObjectMeta{Name: template.Name},
+		Spec: templatev1.RESTSpec{
+			URL:              spec.URL,
+			Auth:             spec.Auth,
+			Headers:          spec.Headers,
+			HeadersFrom:      spec.HeadersFrom,
+			SensitiveHeaders: spec.SensitiveHeaders,
+		},
+	}
+
+	action := spec.RESTAction
+	request, err := tm.RESTManager.renderRequest(rest, data, action)
+	if err != nil {
+		return nil, action, "", err
+	}
+	hash := request.hash()
+	sent := source.GetAnnotations()[fmt.Sprintf(httpRequestAnnotation, template.Name)]
+	if sent == hash {
+		tm.Log.V(2).Info("http request already sent, skipping", "kind", source.GetKind(), "name", source.GetName(), "namespace", source.GetNamespace())
+		return nil, action, hash, nil
+	}
+	if sent != "" {
+		if spec.Update == nil {
+			tm.Log.V(2).Info("http request changed but no update is defined, skipping", "kind", source.GetKind(), "name", source.GetName(), "namespace", source.GetNamespace())
+			return nil, action, hash, nil
+		}
+		action = *spec.Update
+		if request, err = tm.RESTManager.renderRequest(rest, data, action); err != nil {
+			return nil, action, "", err
+		}
+	}
+
+	if _, found := request.Headers[idempotencyKeyHeader]; !found {
+		request.Headers[idempotencyKeyHeader] = fmt.Sprintf("%s-%s-%s", template.Name, source.GetUID(), request.hash()[:16])
+	}
+	return request, action, hash, nil
+}
+
+// validateHTTPOutputs returns an error if the status fields of action are not part of
+// the status schema of source, the API server would silently drop them
+func (tm *TemplateManager) validateHTTPOutputs(source unstructured.Unstructured, action templatev1.RESTAction) error {
+	if tm.SchemaManager == nil {
+		return nil
+	}
+	for _, fields := range []map[string]string{action.Status, action.JSONPath} {
+		for k := range fields {
+			found, err := tm.SchemaManager.HasField(source.GroupVersionKind(), "status."+k)
+			if err != nil {
+				return errors.Wrapf(err, "failed to validate status field %s", k)
+			}
+			if !found {
+				return errors.Errorf("status field %s is not part of the schema of %s, use annotations instead", k, source.GetKind())
+			}
+		}
+	}
+	return nil
+}
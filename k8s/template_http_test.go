@@ -0,0 +1,189 @@
+package k8s_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	"github.com/go-openapi/spec"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var _ = Describe("TemplateHTTP", func() {
+	httpTemplate := func(update *templatev1.RESTAction) *templatev1.Template {
+		template := &templatev1.Template{
+			Spec: templatev1.TemplateSpec{
+				HTTP: &templatev1.TemplateHTTP{
+					RESTAction: templatev1.RESTAction{
+						Method: "POST",
+						URL:    "http://example.com/items",
+						Body:   `{"name": "{{ .metadata.name }}", "size": "{{ .spec.size }}"}`,
+						Status: map[string]string{"itemID": "{{ .response.id }}"},
+					},
+					Update: update,
+				},
+			},
+		}
+		template.Name = "items"
+		return template
+	}
+
+	source := func(size string, annotations map[string]string) unstructured.Unstructured {
+		obj := unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1",
+			"kind":       "Widget",
+			"metadata":   map[string]interface{}{"name": "widget", "uid": "1234"},
+			"spec":       map[string]interface{}{"size": size},
+			"status":     map[string]interface{}{"itemID": "42"},
+		}}
+		obj.SetAnnotations(annotations)
+		return obj
+	}
+
+	templateManager := func() *k8s.TemplateManager {
+		return &k8s.TemplateManager{Log: testLog, RESTManager: &k8s.RESTManager{Log: testLog}}
+	}
+
+	It("Sends the request with an idempotency key", func() {
+		headers, body, hash, err := templateManager().RenderHTTPRequest(httpTemplate(nil), source("1", nil))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal(`{"name": "widget", "size": "1"}`))
+		Expect(headers["Idempotency-Key"]).To(HavePrefix("items-1234-"))
+		Expect(hash).ToNot(BeEmpty())
+
+		// the same request has the same key
+		again, _, _, err := templateManager().RenderHTTPRequest(httpTemplate(nil), source("1", nil))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(again["Idempotency-Key"]).To(Equal(headers["Idempotency-Key"]))
+	})
+
+	It("Skips requests already sent", func() {
+		_, _, hash, err := templateManager().RenderHTTPRequest(httpTemplate(nil), source("1", nil))
+		Expect(err).ToNot(HaveOccurred())
+
+		headers, _, _, err := templateManager().RenderHTTPRequest(httpTemplate(nil), source("1", map[string]string{
+			"platform.flanksource.com/template-operator-http_items": hash,
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(BeNil())
+	})
+
+	It("Does not re-send changed requests without an update", func() {
+		headers, _, _, err := templateManager().RenderHTTPRequest(httpTemplate(nil), source("2", map[string]string{
+			"platform.flanksource.com/template-operator-http_items": "previous",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(BeNil())
+	})
+
+	It("Sends the update of changed requests", func() {
+		update := &templatev1.RESTAction{
+			Method: "PUT",
+			URL:    "http://example.com/items/{{ .status.itemID }}",
+			Body:   `{"size": "{{ .spec.size }}"}`,
+		}
+		_, _, created, err := templateManager().RenderHTTPRequest(httpTemplate(update), source("2", nil))
+		Expect(err).ToNot(HaveOccurred())
+
+		headers, body, hash, err := templateManager().RenderHTTPRequest(httpTemplate(update), source("2", map[string]string{
+			"platform.flanksource.com/template-operator-http_items": "previous",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal(`{"size": "2"}`))
+		Expect(headers["Idempotency-Key"]).To(HavePrefix("items-1234-"))
+		// the hash of the request is recorded so that the update is sent once
+		Expect(hash).To(Equal(created))
+	})
+
+	Describe("Outputs", func() {
+		gvk := func(kind string) string {
+			return fmt.Sprintf("io.k8s.api.core.v1.%s", kind)
+		}
+		swagger := &spec.Swagger{SwaggerProps: spec.SwaggerProps{Definitions: spec.Definitions{
+			gvk("Namespace"): spec.Schema{SchemaProps: spec.SchemaProps{
+				Type: spec.StringOrArray{"object"},
+				Properties: map[string]spec.Schema{
+					"status": *spec.RefSchema("#/definitions/" + gvk("NamespaceStatus")),
+				},
+			}},
+			gvk("NamespaceStatus"): spec.Schema{SchemaProps: spec.SchemaProps{
+				Type: spec.StringOrArray{"object"},
+				Properties: map[string]spec.Schema{
+					"phase": *spec.StringProperty(),
+				},
+			}},
+			gvk("Widget"): spec.Schema{SchemaProps: spec.SchemaProps{
+				Type: spec.StringOrArray{"object"},
+				Properties: map[string]spec.Schema{
+					"status": {
+						SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"object"}},
+						VendorExtensible: spec.VendorExtensible{Extensions: spec.Extensions{
+							"x-kubernetes-preserve-unknown-fields": true,
+						}},
+					},
+				},
+			}},
+		}}}
+
+		templateManager := func() *k8s.TemplateManager {
+			return &k8s.TemplateManager{Log: testLog, SchemaManager: k8s.NewTestSchemaManager(swagger)}
+		}
+
+		namespace := func() unstructured.Unstructured {
+			return unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Namespace"}}
+		}
+
+		It("Rejects status fields missing from the schema of the source", func() {
+			err := templateManager().ValidateHTTPOutputs(httpTemplate(nil), namespace())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("status field itemID is not part of the schema of Namespace"))
+		})
+
+		It("Accepts status fields of the schema of the source", func() {
+			template := httpTemplate(nil)
+			template.Spec.HTTP.Status = map[string]string{"phase": "{{ .response.phase }}"}
+			Expect(templateManager().ValidateHTTPOutputs(template, namespace())).To(Succeed())
+		})
+
+		It("Accepts any field of a status preserving unknown fields", func() {
+			widget := unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Widget"}}
+			Expect(templateManager().ValidateHTTPOutputs(httpTemplate(nil), widget)).To(Succeed())
+		})
+	})
+
+	It("Throttles the requests of all sources with the shared rate limiter", func() {
+		var sent int32
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&sent, 1)
+		}))
+		defer api.Close()
+
+		template := httpTemplate(nil)
+		template.Spec.HTTP.URL = api.URL
+		tm := templateManager()
+		tm.RESTManager.RateLimiter = k8s.NewHostRateLimiter(20, 1)
+
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			widget := source(fmt.Sprint(i), nil)
+			widget.SetName(fmt.Sprintf("widget-%d", i))
+			Expect(tm.SendHTTPRequest(context.Background(), template, widget)).To(Succeed())
+		}
+		// the first request uses the burst, the next 4 wait 50ms each
+		Expect(time.Since(start)).To(BeNumerically(">=", 180*time.Millisecond))
+		Expect(atomic.LoadInt32(&sent)).To(Equal(int32(5)))
+
+		// requests to the host are refused once the context is done while waiting
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		Expect(tm.SendHTTPRequest(ctx, template, source("5", nil))).ToNot(Succeed())
+		Expect(atomic.LoadInt32(&sent)).To(Equal(int32(5)))
+	})
+})
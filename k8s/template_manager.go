@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -27,12 +28,15 @@ import (
 	"github.com/gobwas/glob"
 	"github.com/pkg/errors"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 	extapi "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/typed/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/yaml"
@@ -48,11 +52,39 @@ type TemplateManager struct {
 	kubernetes.Interface
 	Log           logr.Logger
 	PatchApplier  *PatchApplier
+	RESTManager   *RESTManager
 	SchemaManager *SchemaManager
 	SchemaCache   *SchemaCache
 	FuncMap       template.FuncMap
 	Events        record.EventRecorder
 	Watcher       WatcherInterface
+	// Workers is the number of generated objects without dependencies applied
+	// concurrently for a source
+	Workers int
+	// ReadinessRules override the readiness checks of generated objects by kind
+	ReadinessRules []templatev1.ReadinessRule
+	// Revision is the hash of the template revision, set as a label on generated objects
+	Revision string
+	// States holds the state of each source of the template after HandleSource
+	States *SourceStates
+	// TemplateExists returns whether a template exists, claims of deleted templates may
+	// be taken over by any template. Templates are looked up with Client by default
+	TemplateExists func(ctx context.Context, name string) (bool, error)
+	// ResyncPeriod is the interval at which Run is requeued to pick up new sources,
+	// pull git repositories again and restore generated objects that drifted
+	ResyncPeriod time.Duration
+	// PersistRollout is called by Run with the rollout status of the template before
+	// the sources of a new batch are passed to the callback
+	PersistRollout func(ctx context.Context, template *templatev1.Template) error
+
+	// applyNodeFn replaces applyNode if set
+	applyNodeFn func(ctx context.Context, claims *claims, source, target unstructured.Unstructured, graph *dependencyGraph, node *dependencyNode) (bool, error)
+
+	mtx sync.Mutex
+	// rolloutSources are the sources allowed by the rollout once it is computed by Run
+	rolloutSources  map[string]bool
+	rolloutAll      bool
+	rolloutComputed bool
 }
 
 type ResourcePatch struct {
@@ -100,6 +132,11 @@ func NewTemplateManager(c *kommons.Client, log logr.Logger, cache *SchemaCache,
 		return nil, errors.Wrap(err, "faile to create patch applier")
 	}
 
+	restManager, err := NewRESTManager(c, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create rest manager")
+	}
+
 	functions := ktemplate.NewFunctions(clientset)
 
 	tm := &TemplateManager{
@@ -108,10 +145,12 @@ func NewTemplateManager(c *kommons.Client, log logr.Logger, cache *SchemaCache,
 		Log:           log,
 		Events:        events,
 		PatchApplier:  patchApplier,
+		RESTManager:   restManager,
 		SchemaManager: schemaManager,
 		SchemaCache:   cache,
 		Watcher:       watcher,
 		FuncMap:       functions.FuncMap(),
+		States:        NewSourceStates(),
 	}
 	return tm, nil
 }
@@ -142,13 +181,15 @@ func (tm *TemplateManager) GetSourceNamespaces(ctx context.Context, template *te
 	return namespaceNames, nil
 }
 
-func (tm *TemplateManager) selectResources(ctx context.Context, template *templatev1.Template, cb CallbackFunc) ([]unstructured.Unstructured, error) {
+func (tm *TemplateManager) selectResources(ctx context.Context, template *templatev1.Template, cb CallbackFunc) (sources []unstructured.Unstructured, err error) {
+	ctx, span := tracer.Start(ctx, "TemplateManager.selectResources", trace.WithAttributes(attribute.String("template", template.Name)))
+	defer func() { endSpan(span, err) }()
+
 	selector := template.Spec.Source
 
 	if selector.Kind == "" || selector.APIVersion == "" {
 		return nil, errors.New("must specify a kind and apiVersion")
 	}
-	var sources []unstructured.Unstructured
 
 	namespaceNames, err := tm.GetSourceNamespaces(ctx, template)
 	if err != nil {
@@ -157,7 +198,7 @@ func (tm *TemplateManager) selectResources(ctx context.Context, template *templa
 
 	// first iterate over selected namespaces
 	for _, namespace := range namespaceNames {
-		client, err := tm.Client.GetClientByKind(selector.Kind)
+		client, err := ResourceClient(tm.Client, selector.APIVersion, selector.Kind)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to get dynamic client for kind %s", selector.Kind)
 		}
@@ -188,7 +229,25 @@ func (tm *TemplateManager) selectResources(ctx context.Context, template *templa
 	return sources, nil
 }
 
+// Run handles the git repository source of template, or passes each selected source to
+// cb, which is also called by the watcher whenever a source changes. Sources are
+// expected to be handled independently with HandleSource. If the template has a
+// rollout strategy, only the sources of the current batch that are not ready yet are
+// passed to cb, the sources of earlier batches are left to the watcher.
+// Run is requeued after ResyncPeriod unless an earlier requeue is needed
 func (tm *TemplateManager) Run(ctx context.Context, template *templatev1.Template, cb CallbackFunc) (result ctrl.Result, err error) {
+	ctx, span := tracer.Start(ctx, "TemplateManager.Run", trace.WithAttributes(attribute.String("template", template.Name)))
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		if err == nil && !template.Spec.Suspend && result.RequeueAfter == 0 && tm.ResyncPeriod > 0 {
+			result.RequeueAfter = tm.ResyncPeriod
+		}
+	}()
+
+	if template.Spec.Suspend {
+		tm.Log.V(2).Info("template is suspended, skipping", "template", template.Name)
+		return
+	}
 	tm.Log.Info("Reconciling", "template", template.Name)
 	if template.Spec.Source.GitRepository != nil {
 		result, err := tm.handleGitRepository(ctx, template)
@@ -204,10 +263,21 @@ func (tm *TemplateManager) Run(ctx context.Context, template *templatev1.Templat
 		return
 	}
 	tm.Log.Info("Found resources for template", "template", template.Name, "count", len(sources))
+	templateSources.WithLabelValues(template.Name).Observe(float64(len(sources)))
+	tm.States.Retain(keysOf(sources))
+
+	sources, result, err = tm.rollout(template, sources)
+	if err != nil {
+		return
+	}
+	if tm.PersistRollout != nil {
+		if err = tm.PersistRollout(ctx, template); err != nil {
+			return
+		}
+	}
 
 	for _, source := range sources {
-		result, err = tm.HandleSource(ctx, template, source)
-		if err != nil {
+		if err := cb(source); err != nil {
 			return result, err
 		}
 	}
@@ -216,86 +286,106 @@ func (tm *TemplateManager) Run(ctx context.Context, template *templatev1.Templat
 	return
 }
 
+// setRevisionLabel labels obj with the revision of the template it is generated by
+func (tm *TemplateManager) setRevisionLabel(obj *unstructured.Unstructured) {
+	if tm.Revision == "" {
+		return
+	}
+	objLabels := obj.GetLabels()
+	if objLabels == nil {
+		objLabels = map[string]string{}
+	}
+	objLabels[templatev1.TemplateRevisionLabel] = tm.Revision
+	obj.SetLabels(objLabels)
+}
+
+// HandleSource applies template to source and records the outcome in tm.States, it
+// may be called concurrently for different sources of the template
 func (tm *TemplateManager) HandleSource(ctx context.Context, template *templatev1.Template, source unstructured.Unstructured) (result ctrl.Result, err error) {
+	ctx, span := tracer.Start(ctx, "TemplateManager.HandleSource", trace.WithAttributes(
+		attribute.String("template", template.Name),
+		attribute.String("source.kind", source.GetKind()),
+		attribute.String("source.namespace", source.GetNamespace()),
+		attribute.String("source.name", source.GetName()),
+	))
+	defer func() { endSpan(span, err) }()
+
+	// sources queued before the template was suspended are left as they are
+	if template.Spec.Suspend {
+		tm.Log.V(2).Info("template is suspended, skipping source", "template", template.Name, "kind", source.GetKind(), "namespace", source.GetNamespace(), "name", source.GetName())
+		return
+	}
+	sourceKey := SourceKey(source.GetKind(), source.GetNamespace(), source.GetName())
+	previous, _ := tm.States.Get(sourceKey)
+	state := SourceState{Generation: template.Generation, Revision: previous.Revision}
+	defer func() {
+		if err != nil {
+			state.Reason = SourceReasonFailed
+			state.Message = err.Error()
+		}
+		tm.States.Set(sourceKey, state)
+	}()
+
 	target := &source
+	claims := newClaims(template)
 
 	if !template.Spec.Onceoff || !alreadyApplied(template, *target) {
 		for _, patch := range template.Spec.Patches {
-			target, err = tm.PatchApplier.Apply(target, patch, PatchTypeYaml)
+			target, err = tm.PatchApplier.Apply(ctx, target, patch, PatchTypeYaml)
 			if err != nil {
 				tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to apply patch")
 				return
 			}
 		}
 		for _, patch := range template.Spec.JsonPatches {
-			target, err = tm.PatchApplier.Apply(target, patch.Patch, PatchTypeJSON)
+			target, err = tm.PatchApplier.Apply(ctx, target, patch.Patch, PatchTypeJSON)
 			if err != nil {
 				tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to apply patch")
 				return
 			}
 		}
 		if len(template.Spec.JsonPatches) > 0 || len(template.Spec.Patches) > 0 {
+			if err := tm.claimFields(ctx, claims, source, target); err != nil {
+				return result, err
+			}
 			target = markApplied(template, target)
 			stripAnnotations(target)
-			if err := tm.Client.ApplyUnstructured(source.GetNamespace(), target); err != nil {
+			if err := tm.apply(ctx, source.GetNamespace(), target); err != nil {
 				tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to apply object")
 				return result, err
 			}
 		}
 	}
 
-	isSourceReady := true
+	// pending lists the generated resources that are not ready
+	var pending []string
+	reason := SourceReasonReady
 
-	objs, err := tm.getObjectsFromResources(template.Spec.Resources, *target)
+	objs, dependent, err := tm.render(ctx, template, *target)
 	if err != nil {
 		return result, err
 	}
-	tobjs, err := tm.getObjectsFromResourcesTemplate(template.Spec.ResourcesTemplate, *target)
+
+	graph, err := newDependencyGraph(objs, dependent, template.Spec.Dependencies)
 	if err != nil {
+		tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Invalid resource dependencies: %v", err)
 		return result, err
 	}
-	objs = append(objs, tobjs...)
-
-	for _, obj := range objs {
-		ready, msg, err, rslt := tm.checkDependentObjects(&obj, objs)
-		if err != nil {
-			tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to check dependent objects")
-			return result, err
-		}
-		if !ready {
-			result = rslt
-			tm.Log.V(2).Info("Skipping object", "kind", obj.GetKind(), "namespace", obj.GetNamespace(), "name", obj.GetName(), "obj", obj)
-			tm.Log.V(2).Info("Dependent object not ready", "message", msg)
-			continue
-		}
-
-		// cross-namespace owner references are not allowed, so we create an annotation for tracking purposes only
-		if source.GetNamespace() == obj.GetNamespace() {
-			obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: source.GetAPIVersion(), Kind: source.GetKind(), Name: source.GetName(), UID: source.GetUID()}})
-		} else {
-			crossNamespaceOwner(&obj, source)
-		}
-
-		stripAnnotations(&obj)
 
-		if tm.Log.V(2).Enabled() {
-			tm.Log.V(2).Info("Applying", "kind", obj.GetKind(), "namespace", obj.GetNamespace(), "name", obj.GetName(), "obj", obj)
-		} else {
-			tm.Log.Info("Applying", "kind", obj.GetKind(), "namespace", obj.GetNamespace(), "name", obj.GetName())
-		}
-
-		if err := tm.Client.ApplyUnstructured(obj.GetNamespace(), &obj); err != nil {
-			tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to apply new resource kind=%s name=%s err=%v", obj.GetKind(), obj.GetName(), err)
-			return result, err
-		}
+	blocked, notReady, result, err := tm.applyLevels(ctx, claims, source, *target, graph, sourceKey, previous.Blocked)
+	if err != nil {
+		return result, err
+	}
+	pending = append(pending, notReady...)
+	if len(blocked) > 0 {
+		reason = SourceReasonBlocked
+	}
+	state.Blocked = blocked
 
-		if isReady, msg, err := tm.isResourceReady(&obj); err != nil {
-			return result, errors.Wrap(err, "failed to check if resource is ready")
-		} else if !isReady {
-			tm.Log.V(2).Info("resource is not ready", "kind", obj.GetKind(), "name", obj.GetName(), "namespace", obj.GetNamespace(), "message", msg)
-			isSourceReady = false
-		} else {
-			tm.Log.V(2).Info("resource is ready", "kind", obj.GetKind(), "name", obj.GetName(), "namespace", obj.GetNamespace(), "message", msg)
+	for _, b := range blocked {
+		if b.TimedOut {
+			tm.Events.Eventf(&source, v1.EventTypeWarning, "DependencyTimeout", "%s timed out waiting for %s", b, strings.Join(b.WaitingFor, ", "))
+			return result, errors.Errorf("%s timed out waiting for dependencies %s", b, strings.Join(b.WaitingFor, ", "))
 		}
 	}
 
@@ -313,6 +403,13 @@ func (tm *TemplateManager) HandleSource(ctx context.Context, template *templatev
 			kommons.StripIdentifiers(newResource)
 
 			crossNamespaceOwner(newResource, source)
+			if conflict, err := tm.claimObject(ctx, claims, source, newResource); err != nil {
+				return result, err
+			} else if conflict != nil {
+				pending = append(pending, fmt.Sprintf("%s/%s/%s owned by template %s", conflict.Kind, conflict.Namespace, conflict.Name, conflict.Owner))
+				continue
+			}
+			tm.setRevisionLabel(newResource)
 
 			if tm.Log.V(2).Enabled() {
 				tm.Log.V(2).Info("Applying", "kind", newResource.GetKind(), "namespace", newResource.GetNamespace(), "name", newResource.GetName(), "obj", newResource)
@@ -320,34 +417,289 @@ func (tm *TemplateManager) HandleSource(ctx context.Context, template *templatev
 				tm.Log.Info("Applying", "kind", newResource.GetKind(), "namespace", newResource.GetNamespace(), "name", newResource.GetName())
 			}
 
-			if err := tm.Client.ApplyUnstructured(newResource.GetNamespace(), newResource); err != nil {
+			if err := tm.apply(ctx, newResource.GetNamespace(), newResource); err != nil {
 				tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to copy to namespace %s", namespace)
 				return result, err
 			}
 
-			if isReady, msg, err := tm.isResourceReady(newResource); err != nil {
+			if isReady, msg, err := tm.isResourceReady(newResource, nil); err != nil {
 				return result, errors.Wrap(err, "failed to check if resource is ready")
 			} else if !isReady {
 				tm.Log.Info("resource is not ready", "kind", newResource.GetKind(), "name", newResource.GetName(), "namespace", newResource.GetNamespace(), "message", msg)
-				isSourceReady = false
+				pending = append(pending, fmt.Sprintf("%s/%s/%s not ready", newResource.GetKind(), newResource.GetNamespace(), newResource.GetName()))
 			}
 		}
 	}
 
-	conditionName := fmt.Sprintf("template-%s", template.GetName())
-	conditionValue := "NotReady"
-	if isSourceReady {
-		conditionValue = "Ready"
+	if template.Spec.HTTP != nil {
+		if err := tm.handleHTTP(ctx, template, *target, source); err != nil {
+			tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to send http request: %v", err)
+			return result, err
+		}
+	}
+
+	state.Conflicts = claims.conflicts
+	if len(claims.conflicts) > 0 && reason == SourceReasonReady {
+		reason = SourceReasonConflict
+	}
+	if len(pending) > 0 && reason == SourceReasonReady {
+		reason = SourceReasonNotReady
 	}
-	tm.Log.V(2).Info("setting condition on item", "condition", conditionName, "status", conditionValue, "name", source.GetName(), "namespace", source.GetName(), "kind", source.GetKind())
-	if err := tm.Client.SetCondition(&source, conditionName, conditionValue); err != nil {
-		tm.Log.Error(err, "failed to set condition on resource", "kind", source.GetKind(), "name", source.GetName(), "namespace", source.GetNamespace(), "conditionValue", conditionValue)
+	state.Reason = reason
+	state.Message = strings.Join(pending, "; ")
+	state.Revision = tm.Revision
+	if err := tm.setSourceStatus(ctx, template, source, reason, strings.Join(pending, "; ")); err != nil {
+		tm.Log.Error(err, "failed to set status on resource", "kind", source.GetKind(), "name", source.GetName(), "namespace", source.GetNamespace(), "reason", reason)
 	}
 
 	return
 }
 
-func (tm *TemplateManager) Template(data []byte, vars interface{}) ([]byte, error) {
+// applyLevels applies the levels of graph in order, the resources of each level are
+// applied concurrently once the resources they depend on are ready. Resources depending
+// on resources that are not ready are blocked until the next run, they are returned
+// along with the resources that are not ready and the result requeueing the source
+// when the earliest blocked resource times out
+func (tm *TemplateManager) applyLevels(ctx context.Context, claims *claims, source, target unstructured.Unstructured, graph *dependencyGraph, sourceKey string, previous []BlockedResource) (blocked []BlockedResource, pending []string, result ctrl.Result, err error) {
+	ready := map[string]bool{}
+	for _, level := range graph.Levels {
+		var nodes []*dependencyNode
+		for _, node := range level {
+			entry, requeueAfter := blockedOn(node, ready, sourceKey, previous)
+			if entry == nil {
+				nodes = append(nodes, node)
+				continue
+			}
+			tm.Log.V(2).Info("Dependent object not ready, skipping", "id", entry.ID, "kind", entry.Kind, "namespace", entry.Namespace, "name", entry.Name, "waitingFor", entry.WaitingFor)
+			if !isBlocked(previous, *entry) {
+				tm.Events.Eventf(&source, v1.EventTypeNormal, "Blocked", "%s is waiting for %s", entry, strings.Join(entry.WaitingFor, ", "))
+			}
+			blocked = append(blocked, *entry)
+			pending = append(pending, fmt.Sprintf("%s waiting for %s", node, strings.Join(entry.WaitingFor, ", ")))
+			if result.RequeueAfter == 0 || requeueAfter < result.RequeueAfter {
+				result = ctrl.Result{RequeueAfter: requeueAfter}
+			}
+		}
+
+		states, err := tm.applyObjects(ctx, claims, source, target, graph, nodes)
+		if err != nil {
+			return blocked, pending, result, err
+		}
+		for i, node := range nodes {
+			if node.ID != "" {
+				ready[node.ID] = states[i]
+			}
+			if !states[i] {
+				pending = append(pending, fmt.Sprintf("%s not ready", node))
+			}
+		}
+	}
+	return blocked, pending, result, nil
+}
+
+// applyObjects applies nodes generated for source with up to tm.Workers concurrent
+// applies, returning whether each of them is ready. No new object is applied once
+// one failed, and the errors of all applies are returned. Client-side QPS limits of
+// the kubernetes client block workers, so more workers than the client burst do not
+// speed up applies
+func (tm *TemplateManager) applyObjects(ctx context.Context, claims *claims, source, target unstructured.Unstructured, graph *dependencyGraph, nodes []*dependencyNode) ([]bool, error) {
+	workers := tm.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	applyNode := tm.applyNode
+	if tm.applyNodeFn != nil {
+		applyNode = tm.applyNodeFn
+	}
+
+	var (
+		mtx    sync.Mutex
+		wg     sync.WaitGroup
+		failed bool
+	)
+	states := make([]bool, len(nodes))
+	errs := make([]error, len(nodes))
+	hasFailed := func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return failed
+	}
+
+	sem := make(chan struct{}, workers)
+	for i := range nodes {
+		sem <- struct{}{}
+		if hasFailed() {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ready, err := applyNode(ctx, claims, source, target, graph, nodes[i])
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				failed = true
+			}
+			states[i] = ready
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	return states, utilerrors.NewAggregate(errs)
+}
+
+// applyNode renders node if it is a resource depending on others, then applies it and
+// returns whether it is ready
+func (tm *TemplateManager) applyNode(ctx context.Context, claims *claims, source, target unstructured.Unstructured, graph *dependencyGraph, node *dependencyNode) (bool, error) {
+	if node.Raw != nil {
+		if err := tm.renderDependent(ctx, graph, node, target); err != nil {
+			tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to render resource %s: %v", node, err)
+			return false, err
+		}
+		if node.Empty {
+			return true, nil
+		}
+	}
+	return tm.applyObject(ctx, claims, source, node.Object, node.Readiness)
+}
+
+// renderDependent renders the template of node for target, with the live objects of
+// the resources it depends on available as .resources.<id>
+func (tm *TemplateManager) renderDependent(ctx context.Context, graph *dependencyGraph, node *dependencyNode, target unstructured.Unstructured) error {
+	resources := map[string]interface{}{}
+	for _, d := range node.Depends {
+		dependency := graph.IDs[d.ID]
+		if dependency.Empty {
+			continue
+		}
+		live, err := tm.Client.Refresh(&dependency.Object)
+		if err != nil {
+			return errors.Wrapf(err, "failed to refresh resource %s", d.ID)
+		}
+		resources[d.ID] = live.Object
+	}
+
+	vars := target.DeepCopy().Object
+	vars["resources"] = resources
+	objs, err := tm.getObjects(ctx, node.Raw, vars)
+	if err != nil {
+		return err
+	}
+	switch len(objs) {
+	case 0:
+		node.Empty = true
+	case 1:
+		node.Object = *objs[0]
+		stripDependencyFields(&node.Object)
+	default:
+		return errors.Errorf("resource %s generated %d objects, resources depending on others must generate a single object", node, len(objs))
+	}
+	return nil
+}
+
+// applyObject applies obj generated for source and returns whether it is ready
+func (tm *TemplateManager) applyObject(ctx context.Context, claims *claims, source, obj unstructured.Unstructured, readiness *templatev1.Readiness) (bool, error) {
+	// cross-namespace owner references are not allowed, so we create an annotation for tracking purposes only
+	if source.GetNamespace() == obj.GetNamespace() {
+		obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: source.GetAPIVersion(), Kind: source.GetKind(), Name: source.GetName(), UID: source.GetUID()}})
+	} else {
+		crossNamespaceOwner(&obj, source)
+	}
+
+	stripAnnotations(&obj)
+
+	// objects owned by other templates are not ready for this one
+	if conflict, err := tm.claimObject(ctx, claims, source, &obj); err != nil {
+		return false, err
+	} else if conflict != nil {
+		return false, nil
+	}
+
+	tm.setRevisionLabel(&obj)
+
+	if tm.Log.V(2).Enabled() {
+		tm.Log.V(2).Info("Applying", "kind", obj.GetKind(), "namespace", obj.GetNamespace(), "name", obj.GetName(), "obj", obj)
+	} else {
+		tm.Log.Info("Applying", "kind", obj.GetKind(), "namespace", obj.GetNamespace(), "name", obj.GetName())
+	}
+
+	if err := tm.apply(ctx, obj.GetNamespace(), &obj); err != nil {
+		tm.Events.Eventf(&source, v1.EventTypeWarning, "Failed", "Failed to apply new resource kind=%s name=%s err=%v", obj.GetKind(), obj.GetName(), err)
+		return false, err
+	}
+
+	isReady, msg, err := tm.isResourceReady(&obj, readiness)
+	if err != nil {
+		tm.Events.Eventf(&source, v1.EventTypeWarning, "NotReady", "Failed to check readiness of kind=%s name=%s err=%v", obj.GetKind(), obj.GetName(), err)
+		return false, errors.Wrap(err, "failed to check if resource is ready")
+	}
+	if !isReady {
+		tm.Log.V(2).Info("resource is not ready", "kind", obj.GetKind(), "name", obj.GetName(), "namespace", obj.GetNamespace(), "message", msg)
+	} else {
+		tm.Log.V(2).Info("resource is ready", "kind", obj.GetKind(), "name", obj.GetName(), "namespace", obj.GetNamespace(), "message", msg)
+	}
+	return isReady, nil
+}
+
+// render returns the objects generated by the resources and resourcesTemplate of
+// template for target. Resources with a depends field are returned unrendered, they
+// are rendered once the resources they depend on are ready
+func (tm *TemplateManager) render(ctx context.Context, template *templatev1.Template, target unstructured.Unstructured) (objs []unstructured.Unstructured, dependent []runtime.RawExtension, err error) {
+	ctx, span := tracer.Start(ctx, "TemplateManager.render", trace.WithAttributes(attribute.String("template", template.Name)))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	var resources []runtime.RawExtension
+	for _, resource := range template.Spec.Resources {
+		deferred, err := hasDepends(resource.Raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if deferred {
+			dependent = append(dependent, resource)
+		} else {
+			resources = append(resources, resource)
+		}
+	}
+
+	if objs, err = tm.getObjectsFromResources(ctx, resources, target); err != nil {
+		return nil, nil, err
+	}
+	tobjs, err := tm.getObjectsFromResourcesTemplate(ctx, template.Spec.ResourcesTemplate, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	objs = append(objs, tobjs...)
+	templateRenderDuration.WithLabelValues(template.Name).Observe(time.Since(start).Seconds())
+	templateGeneratedObjects.WithLabelValues(template.Name).Observe(float64(len(objs) + len(dependent)))
+	span.SetAttributes(attribute.Int("objects", len(objs)), attribute.Int("dependent", len(dependent)))
+	return objs, dependent, nil
+}
+
+// apply applies obj in namespace, recording its duration
+func (tm *TemplateManager) apply(ctx context.Context, namespace string, obj *unstructured.Unstructured) (err error) {
+	_, span := tracer.Start(ctx, "TemplateManager.apply", trace.WithAttributes(
+		attribute.String("kind", obj.GetKind()),
+		attribute.String("namespace", obj.GetNamespace()),
+		attribute.String("name", obj.GetName()),
+	))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	if err := tm.Client.ApplyUnstructured(namespace, obj); err != nil {
+		return err
+	}
+	observeApply(obj, start)
+	return nil
+}
+
+func (tm *TemplateManager) Template(ctx context.Context, data []byte, vars interface{}) ([]byte, error) {
 	convertedYAML, err := yaml.JSONToYAML(data)
 	if err != nil {
 		return nil, err
@@ -370,18 +722,18 @@ func (tm *TemplateManager) Template(data []byte, vars interface{}) ([]byte, erro
 		return nil, fmt.Errorf("error executing template %s: %v", strings.Split(string(data), "\n")[0], err)
 	}
 
-	return tm.duckTypeTemplateResult(buf.Bytes())
+	return tm.duckTypeTemplateResult(ctx, buf.Bytes())
 }
 
-func (tm *TemplateManager) duckTypeTemplateResult(objYaml []byte) ([]byte, error) {
+func (tm *TemplateManager) duckTypeTemplateResult(ctx context.Context, objYaml []byte) ([]byte, error) {
 	obj := &unstructured.Unstructured{}
 	if err := yaml.Unmarshal(objYaml, &obj.Object); err != nil {
 		return nil, fmt.Errorf("error parsing template result: %v", err)
 	}
-	return tm.duckTypeTemplateResultObject(obj)
+	return tm.duckTypeTemplateResultObject(ctx, obj)
 }
 
-func (tm *TemplateManager) duckTypeTemplateResultObject(obj *unstructured.Unstructured) ([]byte, error) {
+func (tm *TemplateManager) duckTypeTemplateResultObject(ctx context.Context, obj *unstructured.Unstructured) ([]byte, error) {
 	version := obj.GetAPIVersion()
 	parts := strings.Split(version, "/")
 	var apiVersion, apiGroup string
@@ -394,15 +746,18 @@ func (tm *TemplateManager) duckTypeTemplateResultObject(obj *unstructured.Unstru
 	}
 	groupVersionKind := schema.GroupVersionKind{Group: apiGroup, Version: apiVersion, Kind: obj.GetKind()}
 
-	if err := tm.SchemaManager.DuckType(groupVersionKind, obj); err != nil {
+	if err := tm.SchemaManager.DuckType(ctx, groupVersionKind, obj); err != nil {
 		tm.Log.Error(err, "failed to ducktype object")
 	}
 
 	return yaml.Marshal(&obj.Object)
 }
 
-func (tm *TemplateManager) isResourceReady(item *unstructured.Unstructured) (bool, string, error) {
-	if tm.Client.IsTrivialType(item) {
+// isResourceReady returns whether item is ready, according to readiness or the
+// ReadinessRule of its kind if set, and to the kommons heuristics otherwise
+func (tm *TemplateManager) isResourceReady(item *unstructured.Unstructured, readiness *templatev1.Readiness) (bool, string, error) {
+	readiness = tm.readinessFor(item, readiness)
+	if readiness == nil && tm.Client.IsTrivialType(item) {
 		return true, "", nil
 	}
 
@@ -410,11 +765,14 @@ func (tm *TemplateManager) isResourceReady(item *unstructured.Unstructured) (boo
 	if err != nil {
 		return false, "", errors.Wrap(err, "failed to refresh object")
 	}
+	if readiness != nil {
+		return tm.evaluateReadiness(refreshed, readiness)
+	}
 	isReady, msg := tm.Client.IsReady(refreshed)
 	return isReady, msg, nil
 }
 
-func (tm *TemplateManager) getObjects(rawItem []byte, target map[string]interface{}) ([]*unstructured.Unstructured, error) {
+func (tm *TemplateManager) getObjects(ctx context.Context, rawItem []byte, target map[string]interface{}) ([]*unstructured.Unstructured, error) {
 	j, err := json.Marshal(target)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to marshal target")
@@ -438,7 +796,7 @@ func (tm *TemplateManager) getObjects(rawItem []byte, target map[string]interfac
 	}
 
 	if !forEach.IsArray && !forEach.IsMap {
-		data, err := tm.Template(rawItem, targetCopy)
+		data, err := tm.Template(ctx, rawItem, targetCopy)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to template resources")
 		}
@@ -455,7 +813,7 @@ func (tm *TemplateManager) getObjects(rawItem []byte, target map[string]interfac
 		for _, e := range forEach.Array {
 			targetCopy["each"] = e
 
-			data, err := tm.Template(rawItem, targetCopy)
+			data, err := tm.Template(ctx, rawItem, targetCopy)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to template resources")
 			}
@@ -474,7 +832,7 @@ func (tm *TemplateManager) getObjects(rawItem []byte, target map[string]interfac
 				"value": v,
 			}
 
-			data, err := tm.Template(rawItem, targetCopy)
+			data, err := tm.Template(ctx, rawItem, targetCopy)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to template resources")
 			}
@@ -559,16 +917,11 @@ func (tm *TemplateManager) getNamespaces(ctx context.Context, copyToNamespaces t
 }
 
 func (tm *TemplateManager) JSONPath(object interface{}, jsonpath string) (*ForEach, error) {
-	jsonpath = strings.TrimPrefix(jsonpath, "{{")
-	jsonpath = strings.TrimSuffix(jsonpath, "}}")
-	jsonpath = strings.TrimPrefix(jsonpath, ".")
-	jsonObject, err := json.Marshal(object)
+	value, err := getJSONPath(object, jsonpath)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to marshal json")
+		return nil, err
 	}
 
-	value := gjson.Get(string(jsonObject), jsonpath)
-
 	if !value.Exists() {
 		return &ForEach{}, nil
 	}
@@ -592,6 +945,20 @@ func (tm *TemplateManager) JSONPath(object interface{}, jsonpath string) (*ForEa
 	return nil, errors.Errorf("field %s is not map or array", jsonpath)
 }
 
+// getJSONPath returns the value found at the gjson path in object. The path may
+// optionally be wrapped in {{ }} and start with a dot
+func getJSONPath(object interface{}, jsonpath string) (gjson.Result, error) {
+	jsonpath = strings.TrimPrefix(jsonpath, "{{")
+	jsonpath = strings.TrimSuffix(jsonpath, "}}")
+	jsonpath = strings.TrimPrefix(jsonpath, ".")
+	jsonObject, err := json.Marshal(object)
+	if err != nil {
+		return gjson.Result{}, errors.Wrap(err, "failed to marshal json")
+	}
+
+	return gjson.Get(string(jsonObject), jsonpath), nil
+}
+
 func (tm *TemplateManager) handleGitRepository(ctx context.Context, template *templatev1.Template) (result ctrl.Result, err error) {
 	source := template.Spec.Source.GitRepository
 
@@ -766,52 +1133,10 @@ func mkAnnotation(template *templatev1.Template) string {
 	return fmt.Sprintf(alreadyAppliedAnnotation, template.Namespace, template.Name)
 }
 
-// Returns object from the list of objects if the id is found and nil in case id is not found
-func getObjectFromId(id string, objs []unstructured.Unstructured) (*unstructured.Unstructured, error) {
-	for _, obj := range objs {
-		if obj.Object["id"] != nil {
-			if obj.Object["id"].(string) == id {
-				return &obj, nil
-			}
-		}
-	}
-	return nil, fmt.Errorf("No object found with id: %v", id)
-}
-
-// Returns []string with IDs in case a object depends on any other object
-func getDependsOnIds(obj *unstructured.Unstructured) []string {
-	if obj.Object["depends"] != nil {
-		depends := obj.Object["depends"].([]interface{})
-		s := make([]string, len(depends))
-		for i, v := range depends {
-			s[i] = fmt.Sprint(v)
-		}
-		return s
-	}
-	return nil
-}
-
-// checks if all the dependent obj are ready
-func (tm *TemplateManager) checkDependentObjects(obj *unstructured.Unstructured, objs []unstructured.Unstructured) (bool, string, error, ctrl.Result) {
-	if obj.Object["depends"] != nil {
-		ids := getDependsOnIds(obj)
-		for _, id := range ids {
-			dependObj, err := getObjectFromId(id, objs)
-			if err != nil {
-				return false, "", err, ctrl.Result{}
-			}
-			if ready, msg, err := tm.isResourceReady(dependObj); !ready || err != nil {
-				return false, msg, err, ctrl.Result{Requeue: true, RequeueAfter: 2 * time.Minute}
-			}
-		}
-	}
-	return true, "object is ready", nil, ctrl.Result{}
-}
-
-func (tm *TemplateManager) getObjectsFromResources(resources []runtime.RawExtension, target unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+func (tm *TemplateManager) getObjectsFromResources(ctx context.Context, resources []runtime.RawExtension, target unstructured.Unstructured) ([]unstructured.Unstructured, error) {
 	var objs []unstructured.Unstructured
 	for _, item := range resources {
-		obj, err := tm.getObjects(item.Raw, target.Object)
+		obj, err := tm.getObjects(ctx, item.Raw, target.Object)
 		if err != nil {
 			return nil, err
 		}
@@ -822,12 +1147,12 @@ func (tm *TemplateManager) getObjectsFromResources(resources []runtime.RawExtens
 	return objs, nil
 }
 
-func (tm *TemplateManager) getObjectsFromResourcesTemplate(template string, target unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+func (tm *TemplateManager) getObjectsFromResourcesTemplate(ctx context.Context, template string, target unstructured.Unstructured) ([]unstructured.Unstructured, error) {
 	var objs []unstructured.Unstructured
 
 	targetCopy := target.DeepCopy()
 
-	data, err := tm.processTemplate([]byte(template), targetCopy)
+	data, err := tm.processTemplate(ctx, []byte(template), targetCopy)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to template resources")
 	}
@@ -843,7 +1168,7 @@ func (tm *TemplateManager) getObjectsFromResourcesTemplate(template string, targ
 	return objs, nil
 }
 
-func (tm *TemplateManager) processTemplate(data []byte, vars interface{}) ([]byte, error) {
+func (tm *TemplateManager) processTemplate(ctx context.Context, data []byte, vars interface{}) ([]byte, error) {
 	tpl, err := template.New("").Funcs(tm.FuncMap).Parse(string(data))
 
 	if err != nil {
@@ -870,7 +1195,7 @@ func (tm *TemplateManager) processTemplate(data []byte, vars interface{}) ([]byt
 
 	result := ""
 	for _, o := range objs {
-		duckTyped, err := tm.duckTypeTemplateResultObject(o)
+		duckTyped, err := tm.duckTypeTemplateResultObject(ctx, o)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to duck type object")
 		}
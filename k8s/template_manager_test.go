@@ -1,6 +1,7 @@
 package k8s_test
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -75,7 +76,7 @@ spec:
 			templateManager, err := k8s.NewTemplateManager(kommonsClient(), testLog, cache, eventsRecorder, &k8s.NullWatcher{})
 			Expect(err).ToNot(HaveOccurred())
 
-			result, err := templateManager.Template([]byte(templateJSON), db)
+			result, err := templateManager.Template(context.TODO(), []byte(templateJSON), db)
 			Expect(err).ToNot(HaveOccurred())
 
 			yml := string(result)
@@ -0,0 +1,161 @@
+package k8s_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	templatev1 "github.com/flanksource/template-operator/api/v1"
+	"github.com/flanksource/template-operator/k8s"
+	"github.com/go-openapi/spec"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var _ = Describe("Tracing", func() {
+	It("Exports spans and propagates the trace context to REST requests", func() {
+		traceparent := make(chan string, 1)
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			traceparent <- req.Header.Get("traceparent")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "1"}`)) // nolint: errcheck
+		}))
+		defer api.Close()
+
+		// stands in for an OTLP/HTTP collector
+		var exports int32
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/v1/traces" {
+				atomic.AddInt32(&exports, 1)
+			}
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer collector.Close()
+
+		shutdown, err := k8s.SetupTracing(context.Background(), strings.TrimPrefix(collector.URL, "http://"), true)
+		Expect(err).ToNot(HaveOccurred())
+		defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+		rest := &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "tracing", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL: api.URL,
+				Update: templatev1.RESTAction{
+					Method: http.MethodPost,
+					Body:   "{}",
+					Status: map[string]string{"id": "{{ .response.id }}"},
+				},
+			},
+		}
+		restManager := &k8s.RESTManager{Log: testLog}
+
+		ctx, span := otel.Tracer("test").Start(context.Background(), "test")
+		Expect(restManager.Update(ctx, rest)).To(Succeed())
+		span.End()
+
+		Expect(<-traceparent).To(ContainSubstring(span.SpanContext().TraceID().String()))
+		Expect(rest.Status.Outputs["id"]).To(Equal("1"))
+
+		Expect(shutdown(context.Background())).To(Succeed())
+		Expect(atomic.LoadInt32(&exports)).To(BeNumerically(">", 0))
+	})
+
+	It("Only installs the propagator when no endpoint is set", func() {
+		provider := otel.GetTracerProvider()
+		shutdown, err := k8s.SetupTracing(context.Background(), "", false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(otel.GetTracerProvider()).To(BeIdenticalTo(provider))
+		Expect(otel.GetTextMapPropagator().Fields()).To(ContainElement("traceparent"))
+		Expect(shutdown(context.Background())).To(Succeed())
+	})
+
+	It("Records failed REST requests as errors on their spans", func() {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer api.Close()
+
+		recorder := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+		rest := &templatev1.REST{
+			ObjectMeta: metav1.ObjectMeta{Name: "tracing-error", Generation: 1},
+			Spec: templatev1.RESTSpec{
+				URL:    api.URL,
+				Update: templatev1.RESTAction{Method: http.MethodPost, Body: "{}"},
+			},
+		}
+		restManager := &k8s.RESTManager{Log: testLog}
+		Expect(restManager.Update(context.Background(), rest)).ToNot(Succeed())
+
+		var failed []sdktrace.ReadOnlySpan
+		for _, span := range recorder.Ended() {
+			if span.Status().Code == codes.Error {
+				failed = append(failed, span)
+			}
+		}
+		Expect(failed).ToNot(BeEmpty())
+		Expect(failed[0].Events()).ToNot(BeEmpty())
+		Expect(failed[0].Events()[0].Name).To(Equal("exception"))
+	})
+
+	It("Records patches and duck typing as children of the span of the caller", func() {
+		recorder := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+		swagger := &spec.Swagger{SwaggerProps: spec.SwaggerProps{Definitions: spec.Definitions{
+			"io.k8s.api.core.v1.ConfigMap": spec.Schema{SchemaProps: spec.SchemaProps{
+				Type: spec.StringOrArray{"object"},
+				Properties: map[string]spec.Schema{
+					"data": {SchemaProps: spec.SchemaProps{
+						Type:                 spec.StringOrArray{"object"},
+						AdditionalProperties: &spec.SchemaOrBool{Allows: true, Schema: spec.StringProperty()},
+					}},
+				},
+			}},
+		}}}
+		schemaManager := k8s.NewTestSchemaManager(swagger)
+		configMap := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "settings", "namespace": "default"},
+			"data":       map[string]interface{}{"key": "value"},
+		}}
+
+		ctx, parent := otel.Tracer("test").Start(context.Background(), "test")
+		Expect(schemaManager.DuckType(ctx, schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, configMap)).To(Succeed())
+		Expect(schemaManager.DuckType(ctx, schema.GroupVersionKind{Version: "v1", Kind: "Missing"}, configMap)).ToNot(Succeed())
+		_, err := (&k8s.PatchApplier{Log: testLog}).Apply(ctx, configMap, "{{ .source", k8s.PatchTypeYaml)
+		Expect(err).To(HaveOccurred())
+		parent.End()
+
+		spans := map[string][]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			if span.Name() == "test" {
+				continue
+			}
+			Expect(span.Parent().SpanID()).To(Equal(parent.SpanContext().SpanID()))
+			spans[span.Name()] = append(spans[span.Name()], span)
+		}
+		Expect(spans["SchemaManager.DuckType"]).To(HaveLen(2))
+		Expect(spans["SchemaManager.DuckType"][0].Status().Code).ToNot(Equal(codes.Error))
+		Expect(spans["SchemaManager.DuckType"][1].Status().Code).To(Equal(codes.Error))
+		Expect(spans["PatchApplier.Apply"]).To(HaveLen(1))
+		Expect(spans["PatchApplier.Apply"][0].Status().Code).To(Equal(codes.Error))
+		Expect(spans["PatchApplier.Apply"][0].Attributes()).To(ContainElement(attribute.String("kind", "ConfigMap")))
+	})
+})
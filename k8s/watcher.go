@@ -127,6 +127,7 @@ func (w *Watcher) Watch(exampleObject *unstructured.Unstructured, template *temp
 
 	stopper := make(chan struct{})
 	go informer.Run(stopper)
+	watcherInformers.Inc()
 
 	return nil
 }
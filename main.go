@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"time"
@@ -70,12 +71,28 @@ func setupLogger(opts zap.Options) {
 }
 
 func main() {
-	var metricsAddr string
-	var enableLeaderElection bool
+	var metricsAddr, callbackAddr, otlpEndpoint string
+	var enableLeaderElection, otlpInsecure bool
 	var syncPeriod, expire time.Duration
+	var restQPS, kubeQPS float64
+	var restBurst, restConcurrency, restHistoryLimit, kubeBurst int
+	var templateConcurrency, sourceWorkers, applyWorkers, revisionHistoryLimit int
 	flag.DurationVar(&syncPeriod, "sync-period", 5*time.Minute, "The time duration to run a full reconcile")
 	flag.DurationVar(&expire, "expire", 15*time.Minute, "The time duration to expire API resources cache")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.Float64Var(&restQPS, "rest-qps", 10, "The maximum number of REST requests per second sent to each host, 0 to disable.")
+	flag.IntVar(&restBurst, "rest-burst", 20, "The maximum burst of REST requests sent to each host.")
+	flag.IntVar(&restConcurrency, "rest-max-concurrent-reconciles", 1, "The maximum number of REST objects reconciled concurrently, per kind.")
+	flag.IntVar(&restHistoryLimit, "rest-history-limit", 10, "The number of requests kept in the status of each REST object, 0 to disable.")
+	flag.IntVar(&templateConcurrency, "template-max-concurrent-reconciles", 1, "The maximum number of Templates reconciled concurrently.")
+	flag.IntVar(&sourceWorkers, "template-source-workers", 1, "The number of Template sources handled concurrently.")
+	flag.IntVar(&applyWorkers, "template-apply-workers", 1, "The number of generated objects without dependencies applied concurrently for each source.")
+	flag.IntVar(&revisionHistoryLimit, "template-revision-history-limit", 10, "The number of revisions kept for each template.")
+	flag.Float64Var(&kubeQPS, "kube-api-qps", 20, "The maximum number of requests per second sent to the Kubernetes API.")
+	flag.IntVar(&kubeBurst, "kube-api-burst", 30, "The maximum burst of requests sent to the Kubernetes API.")
+	flag.StringVar(&callbackAddr, "callback-addr", "", "The address the REST callback endpoint binds to, e.g. :8082. Disabled if empty.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "The host:port of the OTLP/HTTP collector traces are exported to, empty to disable tracing.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Export traces to the OTLP collector over plain HTTP.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
@@ -85,7 +102,19 @@ func main() {
 	flag.Parse()
 	setupLogger(opts)
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	shutdownTracing, err := k8s.SetupTracing(context.Background(), otlpEndpoint, otlpInsecure)
+	if err != nil {
+		setupLog.Error(err, "unable to setup tracing")
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background()) // nolint: errcheck
+
+	// the client side rate limit applies back-pressure to the template workers
+	config := ctrl.GetConfigOrDie()
+	config.QPS = float32(kubeQPS)
+	config.Burst = kubeBurst
+
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
 		Port:               9443,
@@ -122,6 +151,7 @@ func main() {
 		os.Exit(1)
 	}
 
+	restRateLimiter := k8s.NewHostRateLimiter(restQPS, restBurst)
 	if err = (&controllers.TemplateReconciler{
 		Client: controllers.Client{
 			KommonsClient: client,
@@ -130,6 +160,12 @@ func main() {
 			Scheme:        mgr.GetScheme(),
 			Watcher:       watcher,
 		},
+		MaxConcurrentReconciles: templateConcurrency,
+		SourceWorkers:           sourceWorkers,
+		ApplyWorkers:            applyWorkers,
+		RevisionHistoryLimit:    revisionHistoryLimit,
+		SyncPeriod:              syncPeriod,
+		RateLimiter:             restRateLimiter,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Template")
 		os.Exit(1)
@@ -155,10 +191,43 @@ func main() {
 			Scheme:        mgr.GetScheme(),
 			Watcher:       watcher,
 		},
+		RateLimiter:             restRateLimiter,
+		MaxConcurrentReconciles: restConcurrency,
+		HistoryLimit:            restHistoryLimit,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "REST")
 		os.Exit(1)
 	}
+	if err = (&controllers.NamespacedRESTReconciler{
+		RESTReconciler: controllers.RESTReconciler{
+			Client: controllers.Client{
+				KommonsClient: client,
+				Cache:         schemaCache,
+				Log:           ctrl.Log.WithName("controllers").WithName("NamespacedREST"),
+				Scheme:        mgr.GetScheme(),
+				Watcher:       watcher,
+			},
+			RateLimiter:             restRateLimiter,
+			MaxConcurrentReconciles: restConcurrency,
+			HistoryLimit:            restHistoryLimit,
+		},
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "NamespacedREST")
+		os.Exit(1)
+	}
+	if callbackAddr != "" {
+		if err = (&controllers.RESTCallbackServer{
+			Client: controllers.Client{
+				KommonsClient: client,
+				Log:           ctrl.Log.WithName("controllers").WithName("RESTCallback"),
+				Scheme:        mgr.GetScheme(),
+			},
+			Addr: callbackAddr,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create callback server")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
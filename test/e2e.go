@@ -955,17 +955,13 @@ func waitForRESTUpdatedStatus(restName, generatedID string) (string, error) {
 	if err != nil {
 		return fmt.Sprintf("failed to get rest object: %v", err), err
 	}
-	status, ok := newRest.Object["status"].(map[string]interface{})
-	if !ok {
-		return fmt.Sprintf("failed to to cast rest status to map: %v", err), err
+	silenceID, found, err := unstructured.NestedString(newRest.Object, "status", "outputs", "silenceID")
+	if err != nil {
+		return fmt.Sprintf("expected status.outputs.silenceID to be string: %v", err), err
 	}
-	silenceIDi, found := status["silenceID"]
 	if !found {
-		return fmt.Sprintf("did not find silenceID field in rest status: %v", err), err
-	}
-	silenceID, ok := silenceIDi.(string)
-	if !ok {
-		return fmt.Sprintf("expected status.silenceID to be string: %v", err), err
+		msg := "did not find silenceID field in rest status outputs"
+		return msg, errors.Errorf(msg)
 	}
 
 	if silenceID != generatedID {